@@ -0,0 +1,125 @@
+package ast
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+var errDivisionByZero = errors.New("division by zero")
+
+func isArithmetic(op Symbol) bool {
+	switch op {
+	case "+", "-", "*", "/", "%":
+		return true
+	}
+	return false
+}
+
+// arithmetic applies an arithmetic operator to its operands from left to right.
+// Integers stay integers, except for division which always yields a float64.
+// A single operand of - is negated.
+func arithmetic(op string, args []interface{}) (interface{}, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("%s expects at least 1 operand", op)
+	}
+	if ints, ok := allInts(args); ok && op != "/" {
+		if op == "-" && len(ints) == 1 {
+			return -ints[0], nil
+		}
+		result := ints[0]
+		for _, n := range ints[1:] {
+			switch op {
+			case "+":
+				result += n
+			case "-":
+				result -= n
+			case "*":
+				result *= n
+			case "%":
+				if n == 0 {
+					return nil, errDivisionByZero
+				}
+				result %= n
+			}
+		}
+		return result, nil
+	}
+
+	floats := make([]float64, len(args))
+	for i, arg := range args {
+		f, ok := toFloat(arg)
+		if !ok {
+			return nil, fmt.Errorf("%s expects numbers, got %T", op, arg)
+		}
+		floats[i] = f
+	}
+	if op == "-" && len(floats) == 1 {
+		return -floats[0], nil
+	}
+	result := floats[0]
+	for _, f := range floats[1:] {
+		switch op {
+		case "+":
+			result += f
+		case "-":
+			result -= f
+		case "*":
+			result *= f
+		case "/":
+			if f == 0 {
+				return nil, errDivisionByZero
+			}
+			result /= f
+		case "%":
+			if f == 0 {
+				return nil, errDivisionByZero
+			}
+			result = math.Mod(result, f)
+		}
+	}
+	return result, nil
+}
+
+func allInts(args []interface{}) ([]int, bool) {
+	ints := make([]int, len(args))
+	for i, arg := range args {
+		n, ok := arg.(int)
+		if !ok {
+			return nil, false
+		}
+		ints[i] = n
+	}
+	return ints, true
+}
+
+// toFloat converts any Go number to a float64.
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
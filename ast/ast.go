@@ -1,8 +1,9 @@
 package ast
 
 import (
+	"context"
 	"fmt"
-	"strconv"
+	"regexp"
 	"strings"
 )
 
@@ -11,87 +12,220 @@ import (
 // (and (== age 20) (>= score 51) (in status ("active" "pending")))
 // is represented as:
 // ["and", ["==", "age", 20], [">=", "score", 51], ["in", "status", ["active", "pending"]]]
+// where operators and identifiers such as "and" and "age" are Symbols, and "active" and "pending" are strings.
+// Strings are written in double quotes and support the escapes \", \\, \n, \t, \r and \uXXXX.
+// Comments start with ';' and run to the end of the line.
 // The following operators are supported:
 // - and: logical AND
 // - or: logical OR
 // - not: logical NOT
 // - >, <, >=, <=, ==, !=, <>: comparison operators
-// - in: membership operator
+// - between: inclusive range, e.g. (between latency 100 500)
+// - exists, missing: whether a field is present in the event
+// - in, not_in: membership operators
+// - contains: substring of a string, or element of an array
+// - starts_with, ends_with: prefix and suffix of a string
+// - ieq: case-insensitive equality of strings
+// - matches: regular expression match, e.g. (matches email ".*@example\\.com$")
+// - +, -, *, /, %: arithmetic, e.g. (> (* qty price) 1000)
+// - any, all: quantifiers over the elements of an array, e.g. (any (> items[*].price 100))
+// - window_count, window_sum: aggregates of the events per key in a sliding window, see WithWindows
+// - ref: a named predicate of a Library, e.g. (and (ref is_paying) (> amount 100)), see WithLibrary
+//
+// The windowed aggregates count, or sum a value of, the events they are evaluated for with the same key
+// in the window, including the current one, e.g. more than 5 failed logins of a user within a minute is
+// (and (== event "login_failed") (> (window_count user_id "1m") 5)), and more than 1000 spent
+// with a card within 10 minutes is (> (window_sum amount card_id "10m") 1000).
+//
+// Any other operator is a call to a function registered with RegisterFunc, e.g. (== (lower country) "de").
+// The built-in functions are len, lower, upper, abs, round, coalesce and now, and the time functions
+// within_last, hour_of_day, day_of_week and business_hours, which take timestamps in Unix milliseconds
+// like the ts of a payload (see FromPayload), e.g. (and (within_last ts "5m") (business_hours ts "Europe/Berlin")).
+//
+// Literals are numbers, strings, true, false and null.
+// Identifiers are field paths into the event, such as user.address.city, items[0].sku or items[-1].sku.
+// A field that is not in the event is null: it is only equal to null, other comparisons with it are false,
+// and arithmetic on it yields null. A bare identifier used as a condition is true if it is a true bool,
+// or any other value that is not null.
+// The wildcard [*] stands for the current element of an array and may only be used inside any or all,
+// which evaluate their condition once per element of the first wildcard they contain.
+//
+// Expressions can also be written in infix syntax, see ParseInfix, or in the JSON form above, see ParseJSON,
+// and printed with FormatSExpr, FormatInfix and FormatJSON.
+//
+// Values of different types are converted according to a Coercion policy, lenient by default,
+// so that string properties such as "51" can be compared with numbers.
 type Expression interface{}
 
-// parse S expression
-func ParseExpression(s string) (Expression, error) {
-	tokens := tokenize(s)
-	if len(tokens) == 0 {
-		return nil, fmt.Errorf("empty expression")
-	}
-	return parseTokens(&tokens)
+// Symbol is an operator or an identifier in an expression, as opposed to a string literal.
+type Symbol string
+
+// parse S expression, within the Limits given WithLimits or else the DefaultLimits.
+func ParseExpression(s string, opts ...Option) (Expression, error) {
+	expr, _, err := parse(s, newConfig(opts).limits)
+	return expr, err
 }
 
-func tokenize(s string) []string {
-	s = strings.ReplaceAll(s, "(", " ( ")
-	s = strings.ReplaceAll(s, ")", " ) ")
-	fields := strings.Fields(s)
-	return fields
+// parser builds an expression from tokens, recording the position of every node by its path.
+type parser struct {
+	lex       *lexer
+	tok       token
+	positions map[string]Pos
+	budget    budget
 }
 
-func parseTokens(tokens *[]string) (Expression, error) {
-	if len(*tokens) == 0 {
-		return nil, fmt.Errorf("unexpected end of input")
+func parse(s string, limits Limits) (Expression, map[string]Pos, error) {
+	p := &parser{lex: newLexer(s), positions: make(map[string]Pos), budget: budget{limits: limits}}
+	if err := p.next(); err != nil {
+		return nil, nil, err
+	}
+	if p.tok.kind == tokenEOF {
+		return nil, nil, &SyntaxError{Pos: p.tok.pos, Msg: "empty expression"}
+	}
+	expr, err := p.parseExpr("$", 1)
+	if err != nil {
+		return nil, nil, err
 	}
+	if p.tok.kind != tokenEOF {
+		return nil, nil, &SyntaxError{Pos: p.tok.pos, Token: p.tok.text, Msg: "unexpected token after expression"}
+	}
+	return expr, p.positions, nil
+}
 
-	token := (*tokens)[0]
-	*tokens = (*tokens)[1:]
+func (p *parser) next() error {
+	tok, err := p.lex.next()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
 
-	if token == "(" {
-		var list []interface{}
-		for len(*tokens) > 0 && (*tokens)[0] != ")" {
-			subExpr, err := parseTokens(tokens)
+func (p *parser) parseExpr(path string, depth int) (Expression, error) {
+	tok := p.tok
+	p.positions[path] = tok.pos
+	if err := p.budget.node(path, tok.pos); err != nil {
+		return nil, err
+	}
+	switch tok.kind {
+	case tokenLParen:
+		if err := p.budget.nest(depth, path, tok.pos); err != nil {
+			return nil, err
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		list := []interface{}{}
+		for p.tok.kind != tokenRParen {
+			if p.tok.kind == tokenEOF {
+				return nil, &SyntaxError{Pos: tok.pos, Token: tok.text, Msg: "missing closing parenthesis"}
+			}
+			subExpr, err := p.parseExpr(fmt.Sprintf("%s[%d]", path, len(list)), depth+1)
 			if err != nil {
 				return nil, err
 			}
 			list = append(list, subExpr)
+			// the operator of a call is not one of its operands
+			n := len(list)
+			if isCall(list) {
+				n--
+			}
+			if err := p.budget.items(n, path, tok.pos); err != nil {
+				return nil, err
+			}
 		}
-		if len(*tokens) == 0 {
-			return nil, fmt.Errorf("missing closing parenthesis")
+		return list, p.next() // remove ")"
+	case tokenRParen:
+		return nil, &SyntaxError{Pos: tok.pos, Token: tok.text, Msg: "unexpected )"}
+	case tokenString, tokenNumber:
+		return tok.value, p.next()
+	case tokenSymbol:
+		switch tok.text {
+		case "true":
+			return true, p.next()
+		case "false":
+			return false, p.next()
+		case "null":
+			return nil, p.next()
 		}
-		*tokens = (*tokens)[1:] // remove ")"
-		return list, nil
-	} else if token == ")" {
-		return nil, fmt.Errorf("unexpected )")
-	} else {
-		return tryConvertToken(token), nil
+		return Symbol(tok.text), p.next()
+	default:
+		return nil, &SyntaxError{Pos: tok.pos, Msg: "unexpected end of input"}
 	}
 }
 
-func tryConvertToken(token string) interface{} {
-	if i, err := strconv.Atoi(token); err == nil {
-		return i
+// evaluate expression
+func Evaluate(expr Expression, event map[string]interface{}, opts ...Option) (bool, error) {
+	return EvaluateContext(context.Background(), expr, event, opts...)
+}
+
+// EvaluateContext is Evaluate, stopping with the error of ctx once it is done.
+// ctx is also passed to the functions the expression calls.
+func EvaluateContext(ctx context.Context, expr Expression, event map[string]interface{}, opts ...Option) (bool, error) {
+	cfg := newConfig(opts)
+	expr, err := cfg.expand(expr)
+	if err != nil {
+		return false, err
 	}
-	if f, err := strconv.ParseFloat(token, 64); err == nil {
-		return f
+	env, err := newEnv(ctx, expr, event, cfg)
+	if err != nil {
+		return false, err
 	}
-	if strings.HasPrefix(token, `"`) && strings.HasSuffix(token, `"`) {
-		return token[1 : len(token)-1]
+	return env.evaluate(expr)
+}
+
+// env is the state of one evaluation of an expression against an event.
+type env struct {
+	ctx      context.Context // passed to functions
+	cfg      *optconfig
+	event    map[string]interface{}
+	bindings map[string]int            // wildcard prefix -> index of the element bound to it by an enclosing any or all
+	trace    *Trace                    // the trace of the sub-expression being evaluated, when explaining
+	root     Expression                // the expression being evaluated, which windowed aggregates are located in
+	regexps  map[string]*regexp.Regexp // the patterns of matches compiled with the program, if any
+}
+
+func newEnv(ctx context.Context, expr Expression, event map[string]interface{}, cfg *optconfig) (*env, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := checkLimits(expr, cfg.limits); err != nil {
+		return nil, err
 	}
-	return token
+	if cfg.schema != nil {
+		typed, err := cfg.schema.Apply(event)
+		if err != nil {
+			return nil, err
+		}
+		event = typed
+	}
+	return &env{ctx: context.WithValue(ctx, configKey{}, cfg), cfg: cfg, event: event, root: expr}, nil
 }
 
-// evaluate expression
-func Evaluate(expr Expression, event map[string]interface{}) (bool, error) {
+func (env *env) evaluate(expr Expression) (bool, error) {
+	if env.trace == nil {
+		return env.evaluateCondition(expr)
+	}
+	t := env.enter(expr)
+	result, err := env.evaluateCondition(expr)
+	env.leave(t, result, err)
+	return result, err
+}
+
+func (env *env) evaluateCondition(expr Expression) (bool, error) {
 	switch e := expr.(type) {
 	case []interface{}:
 		if len(e) == 0 {
 			return false, fmt.Errorf("empty expression")
 		}
-		op, ok := e[0].(string)
+		op, ok := e[0].(Symbol)
 		if !ok {
 			return false, fmt.Errorf("invalid operator: %v", e[0])
 		}
 		switch op {
 		case "and":
 			for _, subExpr := range e[1:] {
-				result, err := Evaluate(subExpr, event)
+				result, err := env.evaluate(subExpr)
 				if err != nil {
 					return false, err
 				}
@@ -102,7 +236,7 @@ func Evaluate(expr Expression, event map[string]interface{}) (bool, error) {
 			return true, nil
 		case "or":
 			for _, subExpr := range e[1:] {
-				result, err := Evaluate(subExpr, event)
+				result, err := env.evaluate(subExpr)
 				if err != nil {
 					return false, err
 				}
@@ -115,7 +249,7 @@ func Evaluate(expr Expression, event map[string]interface{}) (bool, error) {
 			if len(e) != 2 {
 				return false, fmt.Errorf("invalid not expression: %v", e)
 			}
-			result, err := Evaluate(e[1], event)
+			result, err := env.evaluate(e[1])
 			if err != nil {
 				return false, err
 			}
@@ -124,15 +258,28 @@ func Evaluate(expr Expression, event map[string]interface{}) (bool, error) {
 			if len(e) != 3 {
 				return false, fmt.Errorf("invalid comparison expression: %v", e)
 			}
-			a, err := getValue(e[1], event)
+			a, err := env.getValue(e[1])
 			if err != nil {
 				return false, err
 			}
-			b, err := getValue(e[2], event)
+			b, err := env.getValue(e[2])
 			if err != nil {
 				return false, err
 			}
-			cmp, err := compare(a, b)
+			switch op {
+			case "==":
+				return env.equal(a, b)
+			case "!=", "<>":
+				eq, err := env.equal(a, b)
+				if err != nil {
+					return false, err
+				}
+				return !eq, nil
+			}
+			if a == nil || b == nil {
+				return false, nil
+			}
+			cmp, err := env.compare(a, b)
 			if err != nil {
 				return false, err
 			}
@@ -145,80 +292,321 @@ func Evaluate(expr Expression, event map[string]interface{}) (bool, error) {
 				return cmp >= 0, nil
 			case "<=":
 				return cmp <= 0, nil
-			case "==":
-				return cmp == 0, nil
-			case "!=", "<>":
-				return cmp != 0, nil
 			}
-		case "in":
+		case "between":
+			if len(e) != 4 {
+				return false, fmt.Errorf("invalid between expression: %v", e)
+			}
+			values, err := env.values(e[1:])
+			if err != nil {
+				return false, err
+			}
+			if values[0] == nil || values[1] == nil || values[2] == nil {
+				return false, nil
+			}
+			low, err := env.compare(values[0], values[1])
+			if err != nil {
+				return false, err
+			}
+			high, err := env.compare(values[0], values[2])
+			if err != nil {
+				return false, err
+			}
+			return low >= 0 && high <= 0, nil
+		case "exists", "missing":
+			if len(e) != 2 {
+				return false, fmt.Errorf("invalid %s expression: %v", op, e)
+			}
+			name, ok := e[1].(Symbol)
+			if !ok {
+				return false, fmt.Errorf("%s expects a field, got %v", op, e[1])
+			}
+			_, found, err := lookup(env.event, string(name), env.bindings)
+			if err != nil {
+				return false, err
+			}
+			return found == (op == "exists"), nil
+		case "in", "not_in":
 			if len(e) != 3 {
-				return false, fmt.Errorf("invalid in expression: %v", e)
+				return false, fmt.Errorf("invalid %s expression: %v", op, e)
 			}
-			value, err := getValue(e[1], event)
+			value, err := env.getValue(e[1])
 			if err != nil {
 				return false, err
 			}
 			list, ok := e[2].([]interface{})
 			if !ok {
-				return false, fmt.Errorf("invalid list for in operator: %v", e[2])
+				return false, fmt.Errorf("invalid list for %s operator: %v", op, e[2])
+			}
+			found, err := env.member(value, list)
+			if err != nil {
+				return false, err
 			}
-			for _, item := range list {
-				cmp, err := compare(value, item)
+			return found == (op == "in"), nil
+		case "contains", "starts_with", "ends_with", "ieq", "matches":
+			if len(e) != 3 {
+				return false, fmt.Errorf("invalid %s expression: %v", op, e)
+			}
+			if _, ok := e[2].(string); op == "matches" && !ok {
+				// as checkMatches does, so that patterns are not read from events
+				return false, fmt.Errorf("matches expects a string literal pattern, got %v", e[2])
+			}
+			a, err := env.getValue(e[1])
+			if err != nil {
+				return false, err
+			}
+			b, err := env.getValue(e[2])
+			if err != nil {
+				return false, err
+			}
+			if a == nil || b == nil {
+				return false, nil
+			}
+			if list, ok := a.([]interface{}); ok && op == "contains" {
+				return env.member(b, list)
+			}
+			s, ok1 := a.(string)
+			sub, ok2 := b.(string)
+			if !ok1 || !ok2 {
+				return false, fmt.Errorf("%s expects strings, got %T and %T", op, a, b)
+			}
+			switch op {
+			case "contains":
+				return strings.Contains(s, sub), nil
+			case "starts_with":
+				return strings.HasPrefix(s, sub), nil
+			case "ends_with":
+				return strings.HasSuffix(s, sub), nil
+			case "ieq":
+				return strings.EqualFold(s, sub), nil
+			case "matches":
+				re, err := env.regexp(sub)
 				if err != nil {
 					return false, err
 				}
-				if cmp == 0 {
-					return true, nil
-				}
+				return re.MatchString(s), nil
 			}
-			return false, nil
+		case "any", "all":
+			if len(e) != 2 {
+				return false, fmt.Errorf("invalid %s expression: %v", op, e)
+			}
+			return env.quantify(op == "all", e[1])
 		default:
-			return false, fmt.Errorf("unknown operator: %s", op)
+			f, ok := lookupFunc(string(op))
+			if !ok {
+				return false, fmt.Errorf("unknown operator: %s", op)
+			}
+			result, err := env.callFunc(string(op), f, e[1:])
+			if err != nil {
+				return false, err
+			}
+			b, ok := result.(bool)
+			if !ok {
+				return false, fmt.Errorf("%s returned %T, not a condition", op, result)
+			}
+			return b, nil
 		}
-	case string:
-		value, err := getValue(e, event)
+	case Symbol:
+		value, err := env.getValue(e)
 		if err != nil {
 			return false, err
 		}
+		if b, ok := value.(bool); ok {
+			return b, nil
+		}
 		return value != nil, nil
+	case bool:
+		return e, nil
 	default:
 		return false, fmt.Errorf("invalid expression: %v", e)
 	}
 	return false, nil
 }
 
-func getValue(token interface{}, event map[string]interface{}) (interface{}, error) {
+// quantify evaluates cond for every element of the array bound by the first unbound wildcard in cond.
+// any is true if cond holds for at least one element, all if it holds for every element,
+// so all is true for an empty or missing array.
+func (env *env) quantify(all bool, cond Expression) (bool, error) {
+	prefix, ok := quantifiedPrefix(cond, func(prefix string) bool {
+		_, bound := env.bindings[prefix]
+		return bound
+	})
+	if !ok {
+		return false, fmt.Errorf("no wildcard path to quantify over in %v", cond)
+	}
+	collection, _, err := lookup(env.event, strings.TrimSuffix(prefix, "[*]"), env.bindings)
+	if err != nil {
+		return false, err
+	}
+	items, _ := collection.([]interface{})
+	if env.bindings == nil {
+		env.bindings = make(map[string]int)
+	}
+	defer delete(env.bindings, prefix)
+	for i := range items {
+		if err := env.ctx.Err(); err != nil {
+			return false, err
+		}
+		env.bindings[prefix] = i
+		result, err := env.evaluate(cond)
+		if err != nil {
+			return false, err
+		}
+		if result != all {
+			return result, nil
+		}
+	}
+	return all, nil
+}
+
+func (env *env) getValue(token interface{}) (interface{}, error) {
+	if env.trace == nil {
+		return env.resolve(token)
+	}
+	var t *Trace
+	if _, ok := token.([]interface{}); ok {
+		t = env.enter(token)
+	}
+	value, err := env.resolve(token)
+	if t != nil {
+		env.leave(t, value, err)
+	}
+	env.trace.Operands = append(env.trace.Operands, value)
+	return value, err
+}
+
+func (env *env) resolve(token interface{}) (interface{}, error) {
 	switch t := token.(type) {
-	case string:
-		if strings.HasPrefix(t, `"`) && strings.HasSuffix(t, `"`) {
-			return t[1 : len(t)-1], nil
+	case Symbol:
+		value, ok, err := lookup(env.event, string(t), env.bindings)
+		if err != nil {
+			return nil, err
 		}
-		if value, ok := event[t]; ok {
+		if ok {
 			return value, nil
 		}
-		return t, nil
+		return nil, nil
+	case []interface{}:
+		return env.call(t)
 	default:
 		return t, nil
 	}
 }
 
+// call evaluates an arithmetic operation or a function call to a value.
+func (env *env) call(e []interface{}) (interface{}, error) {
+	if len(e) == 0 {
+		return nil, fmt.Errorf("empty expression")
+	}
+	op, ok := e[0].(Symbol)
+	if !ok {
+		return nil, fmt.Errorf("invalid operator: %v", e[0])
+	}
+	if isArithmetic(op) {
+		args, err := env.values(e[1:])
+		if err != nil {
+			return nil, err
+		}
+		for i, arg := range args {
+			if arg == nil {
+				return nil, nil
+			}
+			args[i] = env.cfg.coercion.number(arg)
+		}
+		return arithmetic(string(op), args)
+	}
+	if isWindow(string(op)) {
+		args, err := env.values(e[1:])
+		if err != nil {
+			return nil, err
+		}
+		path, _ := exprPath(env.root, e, "$")
+		return windowAggregate(env.ctx, env.cfg, string(op), path, args)
+	}
+	if f, ok := lookupFunc(string(op)); ok {
+		return env.callFunc(string(op), f, e[1:])
+	}
+	return nil, fmt.Errorf("%s is not a value", op)
+}
+
+func (env *env) callFunc(name string, f *function, operands []interface{}) (interface{}, error) {
+	if len(operands) < f.minArgs || (f.maxArgs >= 0 && len(operands) > f.maxArgs) {
+		return nil, fmt.Errorf("invalid number of arguments for %s: %d", name, len(operands))
+	}
+	args, err := env.values(operands)
+	if err != nil {
+		return nil, err
+	}
+	return f.fn(env.ctx, args...)
+}
+
+func (env *env) values(operands []interface{}) ([]interface{}, error) {
+	values := make([]interface{}, len(operands))
+	for i, operand := range operands {
+		value, err := env.getValue(operand)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+// member reports whether value is equal to one of the items.
+func (env *env) member(value interface{}, items []interface{}) (bool, error) {
+	for _, item := range items {
+		eq, err := env.equal(value, item)
+		if err != nil {
+			return false, err
+		}
+		if eq {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// equal reports whether a and b are equal, converting them according to the coercion policy.
+// null is only equal to null.
+func (env *env) equal(a, b interface{}) (bool, error) {
+	if a == nil || b == nil {
+		return a == nil && b == nil, nil
+	}
+	a, b = env.cfg.coercion.coerce(a, b), env.cfg.coercion.coerce(b, a)
+	if x, ok := a.(bool); ok {
+		if y, ok := b.(bool); ok {
+			return x == y, nil
+		}
+	}
+	cmp, err := compare(a, b)
+	if err != nil {
+		return false, err
+	}
+	return cmp == 0, nil
+}
+
+// regexp returns the regular expression of a pattern of matches: the one compiled with the program being explained,
+// or else a new one, since patterns are not cached across expressions.
+func (env *env) regexp(pattern string) (*regexp.Regexp, error) {
+	if re, ok := env.regexps[pattern]; ok {
+		return re, nil
+	}
+	return regexp.Compile(pattern)
+}
+
+// compare returns a negative number, zero or a positive number when a is less than, equal to or greater than b,
+// converting them according to the coercion policy.
+func (env *env) compare(a, b interface{}) (float64, error) {
+	return compare(env.cfg.coercion.coerce(a, b), env.cfg.coercion.coerce(b, a))
+}
+
 func compare(a, b interface{}) (float64, error) {
-	switch a := a.(type) {
-	case int:
-		switch b := b.(type) {
-		case int:
-			return float64(a) - float64(b), nil
-		case float64:
-			return float64(a) - b, nil
-		}
-	case float64:
-		switch b := b.(type) {
-		case int:
-			return a - float64(b), nil
-		case float64:
-			return a - b, nil
-		}
-	case string:
+	if x, ok := toFloat(a); ok {
+		if y, ok := toFloat(b); ok {
+			return x - y, nil
+		}
+	}
+	if a, ok := a.(string); ok {
 		if b, ok := b.(string); ok {
 			return float64(strings.Compare(a, b)), nil
 		}
@@ -13,7 +13,7 @@ func TestAst(t *testing.T) {
 	}
 
 	// t1 := `(and (== age 20) (>= score 51) (in status ("active" "pending")))`
-	t2 := `(== "status" "active")`
+	t2 := `(== status "active")`
 	expr, err := ParseExpression(t2)
 	if err != nil {
 		fmt.Println("Parse error:", err)
@@ -28,3 +28,131 @@ func TestAst(t *testing.T) {
 
 	fmt.Println("Result:", result) // output: true
 }
+
+func TestEvaluateStringOperators(t *testing.T) {
+	event := map[string]interface{}{
+		"email":  "Ops@Example.com",
+		"path":   "/api/v1/report",
+		"status": "active",
+		"tags":   []interface{}{"sale", "new"},
+	}
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{`(contains path "v1")`, true},
+		{`(contains path "v2")`, false},
+		{`(contains tags "new")`, true},
+		{`(contains tags "old")`, false},
+		{`(starts_with path "/api/")`, true},
+		{`(ends_with path "/health_check")`, false},
+		{`(ieq email "ops@example.com")`, true},
+		{`(== email "ops@example.com")`, false},
+		{`(matches email "(?i)^[a-z]+@example\\.com$")`, true},
+		{`(matches path "^/api/v[0-9]+/")`, true},
+		{`(not_in status ("deleted" "banned"))`, true},
+		{`(not_in status ("active" "pending"))`, false},
+	}
+	for _, tt := range tests {
+		p, err := CompileString(tt.expr)
+		if err != nil {
+			t.Errorf("%s: compile: %v", tt.expr, err)
+			continue
+		}
+		got, err := p.Evaluate(event)
+		if err != nil {
+			t.Errorf("%s: evaluate: %v", tt.expr, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: expected %v, got %v", tt.expr, tt.want, got)
+		}
+	}
+
+	for _, expr := range []string{`(matches email "[a-")`, `(matches email pattern)`, `(not_in status "active")`} {
+		if _, err := CompileString(expr); err == nil {
+			t.Errorf("%s: expected a compile error", expr)
+		}
+	}
+	pattern, _ := ParseExpression(`(matches email pattern)`)
+	if _, err := Evaluate(pattern, map[string]interface{}{"email": "a@b", "pattern": ".*"}); err == nil {
+		t.Error("evaluated matches with a pattern read from the event")
+	}
+}
+
+func TestEvaluateLiteralsAndExistence(t *testing.T) {
+	event := map[string]interface{}{
+		"latency": 250,
+		"vip":     true,
+		"banned":  false,
+		"note":    nil,
+		"user":    map[string]interface{}{"id": "u1"},
+		"flag":    "true",
+	}
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{`true`, true},
+		{`(not false)`, true},
+		{`vip`, true},
+		{`banned`, false},
+		{`missing_field`, false},
+		{`(== vip true)`, true},
+		{`(== flag true)`, true},
+		{`(== note null)`, true},
+		{`(== missing_field null)`, true},
+		{`(== missing_field "missing_field")`, false},
+		{`(!= missing_field "x")`, true},
+		{`(> missing_field 1)`, false},
+		{`(< missing_field 1)`, false},
+		{`(== (+ missing_field 1) null)`, true},
+		{`(in missing_field ("a" null))`, true},
+		{`(contains missing_field "a")`, false},
+		{`(exists latency)`, true},
+		{`(exists note)`, true},
+		{`(exists user.id)`, true},
+		{`(exists user.name)`, false},
+		{`(missing user.name)`, true},
+		{`(missing latency)`, false},
+		{`(between latency 100 500)`, true},
+		{`(between latency 250 250)`, true},
+		{`(between latency 300 500)`, false},
+		{`(between missing_field 100 500)`, false},
+	}
+	for _, tt := range tests {
+		p, err := CompileString(tt.expr)
+		if err != nil {
+			t.Errorf("%s: compile: %v", tt.expr, err)
+			continue
+		}
+		got, err := p.Evaluate(event)
+		if err != nil {
+			t.Errorf("%s: evaluate: %v", tt.expr, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: expected %v, got %v", tt.expr, tt.want, got)
+		}
+	}
+
+	for _, expr := range []string{`(exists "latency")`, `(between latency 1)`, `null`, `42`} {
+		if _, err := CompileString(expr); err == nil {
+			t.Errorf("%s: expected a compile error", expr)
+		}
+	}
+}
+
+func TestMatchesPatternsBelongToTheProgram(t *testing.T) {
+	p, err := CompileString(`(or (matches email "^a") (matches email "^b"))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.regexps) != 2 {
+		t.Errorf("compiled %d patterns, want 2", len(p.regexps))
+	}
+	trace, err := p.Explain(map[string]interface{}{"email": "bob"})
+	if err != nil || trace.Result != true {
+		t.Errorf("got %v, %v", trace, err)
+	}
+}
@@ -0,0 +1,271 @@
+package ast
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// resultTypes are the types of the results of the built-in functions that always return the same type.
+var resultTypes = map[string]Type{
+	"len":         TypeNumber,
+	"lower":       TypeString,
+	"upper":       TypeString,
+	"abs":         TypeNumber,
+	"round":       TypeNumber,
+	"now":         TypeNumber,
+	"within_last": TypeBool,
+	"hour_of_day": TypeNumber,
+	"day_of_week": TypeNumber,
+
+	"business_hours": TypeBool,
+	"window_count":   TypeNumber,
+	"window_sum":     TypeNumber,
+}
+
+// Check compiles the expression and type-checks it against the schema of the events it will be evaluated against.
+// See Program.Check.
+func Check(expr Expression, schema Schema) error {
+	p, err := Compile(expr)
+	if err != nil {
+		return err
+	}
+	return p.Check(schema)
+}
+
+// Check type-checks the program against the schema of the events it will be evaluated against,
+// and returns CompileErrors listing every problem found: fields that are not in the schema,
+// comparisons of values of different types such as a string field with a number,
+// operators applied to values of the wrong type, items of in lists that are not of the type of the field,
+// and literals that are not among the values of a field with an enum.
+// Fields of the program are evaluated as null when they are missing from an event, so comparing them with null is fine.
+func (p *Program) Check(schema Schema) error {
+	c := &checker{schema: schema}
+	c.cond("$", p.Root)
+	if len(c.errs) > 0 {
+		return c.errs
+	}
+	return nil
+}
+
+type checker struct {
+	compiler
+	schema Schema
+}
+
+func (c *checker) cond(path string, n Node) {
+	switch n := n.(type) {
+	case *Ident:
+		c.field(path, n.Name)
+	case *Call:
+		c.call(path, n)
+	}
+}
+
+func (c *checker) call(path string, n *Call) {
+	argPath := func(i int) string { return fmt.Sprintf("%s[%d]", path, i+1) }
+	switch n.Op {
+	case "and", "or", "not", "any", "all":
+		for i, arg := range n.Args {
+			c.cond(argPath(i), arg)
+		}
+	case "==", "!=", "<>", "<", ">", "<=", ">=", "between":
+		t, ok := c.value(argPath(0), n.Args[0])
+		ordered := n.Op != "==" && n.Op != "!=" && n.Op != "<>"
+		if ordered && ok && t == TypeBool {
+			c.errorf(path, "%s cannot order %s", n.Op, describe(n.Args[0], t))
+		}
+		for i, arg := range n.Args[1:] {
+			if u, uok := c.value(argPath(i+1), arg); ok && uok && t != u {
+				c.errorf(path, "cannot compare %s with %s", describe(n.Args[0], t), describe(arg, u))
+			}
+			c.enum(argPath(i+1), n.Args[0], arg)
+			c.enum(argPath(0), arg, n.Args[0])
+		}
+	case "in", "not_in":
+		t, ok := c.value(argPath(0), n.Args[0])
+		list, _ := n.Args[1].(*List)
+		if list == nil {
+			return
+		}
+		for i, item := range list.Items {
+			itemPath := fmt.Sprintf("%s[%d]", argPath(1), i)
+			if u, uok := c.value(itemPath, item); ok && uok && t != u {
+				c.errorf(itemPath, "%s is a %s, not a %s like %s", describe(item, u), u, t, describe(n.Args[0], t))
+			}
+			c.enum(itemPath, n.Args[0], item)
+		}
+	case "contains", "starts_with", "ends_with", "ieq", "matches":
+		for i, arg := range n.Args {
+			if t, ok := c.value(argPath(i), arg); ok && t != TypeString {
+				c.errorf(argPath(i), "%s expects strings, got %s", n.Op, describe(arg, t))
+			}
+		}
+	case "exists", "missing":
+		c.value(argPath(0), n.Args[0])
+	default:
+		if t, ok := c.value(path, n); ok && t != TypeBool {
+			c.errorf(path, "%s returns a %s, not a condition", n.Op, t)
+		}
+	}
+}
+
+// value checks a value node and returns its type, if it is known.
+func (c *checker) value(path string, n Node) (Type, bool) {
+	switch n := n.(type) {
+	case *Literal:
+		return literalType(n.Value)
+	case *Ident:
+		f, ok := c.field(path, n.Name)
+		return f.Type, ok
+	case *Call:
+		arithmetic := isArithmetic(Symbol(n.Op))
+		for i, arg := range n.Args {
+			argPath := fmt.Sprintf("%s[%d]", path, i+1)
+			if t, ok := c.value(argPath, arg); ok && arithmetic && t != TypeNumber {
+				c.errorf(argPath, "%s expects numbers, got %s", n.Op, describe(arg, t))
+			}
+		}
+		if arithmetic {
+			return TypeNumber, true
+		}
+		t, ok := resultTypes[n.Op]
+		return t, ok
+	}
+	return 0, false
+}
+
+func literalType(v interface{}) (Type, bool) {
+	switch v.(type) {
+	case string:
+		return TypeString, true
+	case bool:
+		return TypeBool, true
+	case nil:
+		return 0, false
+	}
+	_, ok := toFloat(v)
+	return TypeNumber, ok
+}
+
+// field returns the declaration of a field in the schema, reporting it when it is not declared.
+// Indexes in paths are matched by the [*] of the declarations, e.g. items[0].price by items[*].price.
+func (c *checker) field(path string, name string) (Field, bool) {
+	if f, ok := c.schema[name]; ok {
+		return f, true
+	}
+	if isPath(name) {
+		if f, ok := c.schema[wildcardPath(name)]; ok {
+			return f, true
+		}
+	}
+	if suggestion := c.closest(name); suggestion != "" {
+		c.errorf(path, "unknown field %s, did you mean %s?", name, suggestion)
+	} else {
+		c.errorf(path, "unknown field %s", name)
+	}
+	return Field{}, false
+}
+
+// wildcardPath replaces the indexes of a path by wildcards.
+func wildcardPath(name string) string {
+	segments, err := parsePath(name)
+	if err != nil {
+		return name
+	}
+	var sb strings.Builder
+	for i, seg := range segments {
+		switch {
+		case seg.isIndex:
+			sb.WriteString("[*]")
+		case i > 0:
+			sb.WriteString("." + seg.key)
+		default:
+			sb.WriteString(seg.key)
+		}
+	}
+	return sb.String()
+}
+
+// closest returns the field of the schema closest to name, if it is close enough to be a typo of it.
+func (c *checker) closest(name string) string {
+	names := make([]string, 0, len(c.schema))
+	for field := range c.schema {
+		names = append(names, field)
+	}
+	sort.Strings(names)
+	best, bestDistance := "", 3
+	for _, field := range names {
+		if d := editDistance(name, field); d < bestDistance {
+			best, bestDistance = field, d
+		}
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// enum checks that a literal compared with a field with an enum is one of its values.
+func (c *checker) enum(path string, field, literal Node) {
+	ident, ok := field.(*Ident)
+	lit, isLit := literal.(*Literal)
+	if !ok || !isLit || lit.Value == nil {
+		return
+	}
+	f, ok := c.schema[ident.Name]
+	if !ok && isPath(ident.Name) {
+		f, ok = c.schema[wildcardPath(ident.Name)]
+	}
+	if !ok || f.Enum == nil {
+		return
+	}
+	for _, v := range f.Enum {
+		if sameValue(v, lit.Value) {
+			return
+		}
+	}
+	s, _ := formatLiteral(lit.Value)
+	c.errorf(path, "%s is not one of the values of %s", s, ident.Name)
+}
+
+func sameValue(a, b interface{}) bool {
+	if x, ok := a.(bool); ok {
+		y, ok := b.(bool)
+		return ok && x == y
+	}
+	cmp, err := compare(a, b)
+	return err == nil && cmp == 0
+}
+
+// describe describes a value node of type t for error messages, e.g. string field status or number 5.
+func describe(n Node, t Type) string {
+	switch n := n.(type) {
+	case *Ident:
+		return fmt.Sprintf("%s field %s", t, n.Name)
+	case *Literal:
+		s, _ := formatLiteral(n.Value)
+		return fmt.Sprintf("%s %s", t, s)
+	case *Call:
+		return fmt.Sprintf("%s result of %s", t, n.Op)
+	}
+	return t.String()
+}
@@ -0,0 +1,61 @@
+package ast
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	schema := Schema{
+		"status":         {Type: TypeString, Enum: []interface{}{"active", "pending", "banned"}},
+		"amount":         {Type: TypeNumber},
+		"vip":            {Type: TypeBool},
+		"country":        {Type: TypeString},
+		"user.tier":      {Type: TypeString, Enum: []interface{}{"gold", "silver"}},
+		"items[*].price": {Type: TypeNumber},
+		"ts":             {Type: TypeNumber},
+	}
+	tests := []struct {
+		expr string
+		errs []string // substrings of the expected errors, in order
+	}{
+		{`(and (== status "active") (> amount 100) vip (in country ("DE" "FR")))`, nil},
+		{`(and (== user.tier "gold") (any (> items[*].price 10)) (== items[0].price 5))`, nil},
+		{`(and (== (lower country) "de") (> (* amount 2) 10) (== coupon_missing_field null))`, []string{"$[3][1]: unknown field coupon_missing_field"}},
+		{`(== stauts "active")`, []string{"$[1]: unknown field stauts, did you mean status?"}},
+		{`(> amount "100")`, []string{`$: cannot compare number field amount with string "100"`}},
+		{`(== status amount)`, []string{"$: cannot compare string field status with number field amount"}},
+		{`(between amount 1 "9")`, []string{`$: cannot compare number field amount with string "9"`}},
+		{`(< vip true)`, []string{"$: < cannot order bool field vip"}},
+		{`(in amount (1 "2" 3.5 null))`, []string{`$[2][1]: string "2" is a string, not a number like number field amount`}},
+		{`(in status ("active" "actve"))`, []string{`$[2][1]: "actve" is not one of the values of status`}},
+		{`(!= "gld" user.tier)`, []string{`$[1]: "gld" is not one of the values of user.tier`}},
+		{`(contains amount "1")`, []string{"$[1]: contains expects strings, got number field amount"}},
+		{`(> (+ status 1) 2)`, []string{"$[1][1]: + expects numbers, got string field status"}},
+		{`(and (lower status) (exists user.name))`, []string{"$[1]: lower returns a string, not a condition", "$[2][1]: unknown field user.name"}},
+		{`(within_last ts "5m")`, nil},
+	}
+	for _, tt := range tests {
+		expr, err := ParseExpression(tt.expr)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.expr, err)
+		}
+		err = Check(expr, schema)
+		if len(tt.errs) == 0 {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tt.expr, err)
+			}
+			continue
+		}
+		errs, ok := err.(CompileErrors)
+		if !ok || len(errs) != len(tt.errs) {
+			t.Errorf("%s: expected %d errors, got %v", tt.expr, len(tt.errs), err)
+			continue
+		}
+		for i, want := range tt.errs {
+			if !strings.Contains(errs[i].Error(), want) {
+				t.Errorf("%s: expected %q, got %q", tt.expr, want, errs[i].Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package ast
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Coercion is the policy for converting values of different types when they meet in an expression.
+// Event properties collected through the API are all strings (see encoding.Payload.GetProperties),
+// so comparing them with numeric literals needs a policy.
+type Coercion int
+
+const (
+	// CoercionLenient parses a string as a number when it is compared with a number
+	// or used in arithmetic, e.g. "51" >= 50 is true, and as a bool when it is compared with a bool. Strings that are not numbers are not converted,
+	// and comparing them with a number is an error.
+	CoercionLenient Coercion = iota
+	// CoercionStrict never converts values: comparing a string with a number is an error.
+	CoercionStrict
+)
+
+func (c Coercion) String() string {
+	switch c {
+	case CoercionLenient:
+		return "lenient"
+	case CoercionStrict:
+		return "strict"
+	}
+	return fmt.Sprintf("Coercion(%d)", int(c))
+}
+
+// Type is the type of a field of an event.
+type Type int
+
+const (
+	TypeString Type = iota
+	TypeNumber
+	TypeBool
+)
+
+func (t Type) String() string {
+	switch t {
+	case TypeString:
+		return "string"
+	case TypeNumber:
+		return "number"
+	case TypeBool:
+		return "bool"
+	}
+	return fmt.Sprintf("Type(%d)", int(t))
+}
+
+// Field describes a field of an event.
+type Field struct {
+	Type Type
+	Enum []interface{} // the values the field can take, if they are limited, e.g. "active" and "pending"
+}
+
+// Schema declares the fields of an event by name. Nested fields are declared by path,
+// with [*] for the elements of arrays, e.g. user.tier or items[*].price.
+// Apply only converts the top-level fields, while Check also knows the nested ones.
+type Schema map[string]Field
+
+// Apply returns a copy of the event whose fields declared in the schema are converted to their type.
+// Fields that are not declared are left as they are.
+func (s Schema) Apply(event map[string]interface{}) (map[string]interface{}, error) {
+	typed := make(map[string]interface{}, len(event))
+	for name, value := range event {
+		field, ok := s[name]
+		if !ok || value == nil {
+			typed[name] = value
+			continue
+		}
+		v, err := convert(value, field.Type)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", name, err)
+		}
+		typed[name] = v
+	}
+	return typed, nil
+}
+
+func convert(value interface{}, t Type) (interface{}, error) {
+	switch t {
+	case TypeString:
+		if s, ok := value.(string); ok {
+			return s, nil
+		}
+		return fmt.Sprint(value), nil
+	case TypeNumber:
+		if _, ok := toFloat(value); ok {
+			return value, nil
+		}
+		if s, ok := value.(string); ok {
+			if n, ok := parseNumber(strings.TrimSpace(s)); ok {
+				return n, nil
+			}
+		}
+		return nil, fmt.Errorf("%v is not a number", value)
+	case TypeBool:
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+		case string:
+			if b, err := strconv.ParseBool(strings.TrimSpace(v)); err == nil {
+				return b, nil
+			}
+		}
+		return nil, fmt.Errorf("%v is not a bool", value)
+	}
+	return nil, fmt.Errorf("unknown type %s", t)
+}
+
+// FromProperties converts the properties of a payload to an event that expressions can be evaluated against.
+func FromProperties(properties map[string]string) map[string]interface{} {
+	event := make(map[string]interface{}, len(properties))
+	for k, v := range properties {
+		event[k] = v
+	}
+	return event
+}
+
+// parseNumber parses a number written as in expressions, as an int if possible or else as a float64.
+func parseNumber(s string) (interface{}, bool) {
+	i, f, isInt, ok := parseNumeric(s)
+	switch {
+	case !ok:
+		return nil, false
+	case isInt:
+		return i, true
+	}
+	return f, true
+}
+
+// parseNumeric is parseNumber without boxing the result: an int when isInt, or else a float64.
+func parseNumeric(s string) (i int, f float64, isInt bool, ok bool) {
+	if !looksNumeric(s) || strings.ContainsAny(s, "_xXpP") {
+		return 0, 0, false, false
+	}
+	if isInteger(s) {
+		if i, err := strconv.Atoi(s); err == nil {
+			return i, 0, true, true
+		}
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return 0, f, false, true
+	}
+	return 0, 0, false, false
+}
+
+// isInteger reports whether s is made of digits with an optional sign,
+// so that parsing other numbers does not go through a failed strconv.Atoi.
+func isInteger(s string) bool {
+	if s != "" && (s[0] == '-' || s[0] == '+') {
+		s = s[1:]
+	}
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// parseBool parses a bool like strconv.ParseBool, without allocating an error when s is not one.
+func parseBool(s string) (bool, bool) {
+	switch s {
+	case "1", "t", "T", "true", "TRUE", "True":
+		return true, true
+	case "0", "f", "F", "false", "FALSE", "False":
+		return false, true
+	}
+	return false, false
+}
+
+// coerce converts a to the type of b when the policy allows it, so that they can be compared.
+func (c Coercion) coerce(a, b interface{}) interface{} {
+	if c != CoercionLenient {
+		return a
+	}
+	if s, ok := a.(string); ok {
+		if _, ok := toFloat(b); ok {
+			if n, ok := parseNumber(strings.TrimSpace(s)); ok {
+				return n
+			}
+		}
+		if _, ok := b.(bool); ok {
+			if v, ok := parseBool(strings.TrimSpace(s)); ok {
+				return v
+			}
+		}
+	}
+	return a
+}
+
+// number converts v to a number for arithmetic when the policy allows it.
+func (c Coercion) number(v interface{}) interface{} {
+	if s, ok := v.(string); ok && c == CoercionLenient {
+		if n, ok := parseNumber(strings.TrimSpace(s)); ok {
+			return n
+		}
+	}
+	return v
+}
@@ -0,0 +1,75 @@
+package ast
+
+import (
+	"testing"
+)
+
+func TestCoercion(t *testing.T) {
+	event := FromProperties(map[string]string{
+		"score":  "51",
+		"ratio":  " 0.75 ",
+		"qty":    "3",
+		"status": "active",
+		"zip":    "01234",
+		"name":   "alice",
+	})
+	tests := []struct {
+		expr     string
+		coercion Coercion
+		want     bool
+		wantErr  bool
+	}{
+		{`(>= score 51)`, CoercionLenient, true, false},
+		{`(< ratio 1)`, CoercionLenient, true, false},
+		{`(in score (50 51 52))`, CoercionLenient, true, false},
+		{`(== (* qty 2) 6)`, CoercionLenient, true, false},
+		{`(== zip "01234")`, CoercionLenient, true, false},
+		{`(== zip 1234)`, CoercionLenient, true, false},
+		{`(> name 1)`, CoercionLenient, false, true},
+		{`(>= score 51)`, CoercionStrict, false, true},
+		{`(== (* qty 2) 6)`, CoercionStrict, false, true},
+		{`(== status "active")`, CoercionStrict, true, false},
+	}
+	for _, tt := range tests {
+		expr, err := ParseExpression(tt.expr)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.expr, err)
+		}
+		got, err := Evaluate(expr, event, WithCoercion(tt.coercion))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s (%s): unexpected error: %v", tt.expr, tt.coercion, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s (%s): expected %v, got %v", tt.expr, tt.coercion, tt.want, got)
+		}
+	}
+}
+
+func TestSchema(t *testing.T) {
+	schema := Schema{
+		"score": {Type: TypeNumber},
+		"vip":   {Type: TypeBool},
+		"zip":   {Type: TypeString},
+	}
+	event := FromProperties(map[string]string{"score": "51", "vip": "true", "zip": "01234"})
+
+	typed, err := schema.Apply(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if typed["score"] != 51 || typed["vip"] != true || typed["zip"] != "01234" {
+		t.Errorf("unexpected typed event: %#v", typed)
+	}
+
+	p, err := CompileString(`(>= score 51)`, WithCoercion(CoercionStrict), WithSchema(schema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := p.Evaluate(event); err != nil || !ok {
+		t.Errorf("expected true, got %v, %v", ok, err)
+	}
+	if _, err := p.Evaluate(FromProperties(map[string]string{"score": "high"})); err == nil {
+		t.Errorf("expected an error for a score that is not a number")
+	}
+}
@@ -0,0 +1,437 @@
+package ast
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Node is a typed node of a compiled expression.
+type Node interface {
+	node()
+}
+
+// Call is an operator applied to its operands, e.g. (== age 20).
+type Call struct {
+	Op   string
+	Args []Node
+}
+
+// List is a literal list, e.g. ("active" "pending").
+type List struct {
+	Items []Node
+}
+
+// Ident is a reference to a field of the event, possibly nested such as user.address.city or items[*].price.
+// When the event has no such field, the identifier evaluates to null.
+type Ident struct {
+	Name string
+}
+
+// Literal is a constant number, string, bool or null.
+type Literal struct {
+	Value interface{}
+}
+
+func (*Call) node()    {}
+func (*List) node()    {}
+func (*Ident) node()   {}
+func (*Literal) node() {}
+
+// kind is the kind of node an operator accepts as operand or produces as result.
+type kind int
+
+const (
+	kindBool  kind = iota // a condition: a boolean operator, a bare identifier or a bool literal
+	kindValue             // a value: an identifier or a literal
+	kindList              // a literal list
+)
+
+func (k kind) String() string {
+	switch k {
+	case kindBool:
+		return "condition"
+	case kindValue:
+		return "value"
+	case kindList:
+		return "list"
+	}
+	return "unknown"
+}
+
+// operator describes the operands accepted by an operator and the kind of its result.
+type operator struct {
+	args     []kind // kinds of the fixed operands
+	variadic bool   // the last kind in args may repeat
+	min      int    // minimum number of operands when variadic
+	result   kind
+	check    func(c *compiler, path string, args []Node) // optional validation of the compiled operands
+}
+
+var operators = map[string]*operator{
+	"and": {args: []kind{kindBool}, variadic: true, min: 1, result: kindBool},
+	"or":  {args: []kind{kindBool}, variadic: true, min: 1, result: kindBool},
+	"not": {args: []kind{kindBool}, result: kindBool},
+	">":   {args: []kind{kindValue, kindValue}, result: kindBool},
+	"<":   {args: []kind{kindValue, kindValue}, result: kindBool},
+	">=":  {args: []kind{kindValue, kindValue}, result: kindBool},
+	"<=":  {args: []kind{kindValue, kindValue}, result: kindBool},
+	"==":  {args: []kind{kindValue, kindValue}, result: kindBool},
+	"!=":  {args: []kind{kindValue, kindValue}, result: kindBool},
+	"<>":  {args: []kind{kindValue, kindValue}, result: kindBool},
+	"in":  {args: []kind{kindValue, kindList}, result: kindBool},
+	"any": {args: []kind{kindBool}, result: kindBool},
+	"all": {args: []kind{kindBool}, result: kindBool},
+
+	"not_in":      {args: []kind{kindValue, kindList}, result: kindBool},
+	"contains":    {args: []kind{kindValue, kindValue}, result: kindBool},
+	"starts_with": {args: []kind{kindValue, kindValue}, result: kindBool},
+	"ends_with":   {args: []kind{kindValue, kindValue}, result: kindBool},
+	"ieq":         {args: []kind{kindValue, kindValue}, result: kindBool},
+	"matches":     {args: []kind{kindValue, kindValue}, result: kindBool, check: checkMatches},
+
+	"between": {args: []kind{kindValue, kindValue, kindValue}, result: kindBool},
+	"exists":  {args: []kind{kindValue}, result: kindBool, check: checkField},
+	"missing": {args: []kind{kindValue}, result: kindBool, check: checkField},
+
+	"+": {args: []kind{kindValue}, variadic: true, min: 2, result: kindValue},
+	"-": {args: []kind{kindValue}, variadic: true, min: 1, result: kindValue},
+	"*": {args: []kind{kindValue}, variadic: true, min: 2, result: kindValue},
+	"/": {args: []kind{kindValue, kindValue}, result: kindValue},
+	"%": {args: []kind{kindValue, kindValue}, result: kindValue},
+
+	"window_count": {args: []kind{kindValue, kindValue}, result: kindValue, check: checkWindow},
+	"window_sum":   {args: []kind{kindValue, kindValue, kindValue}, result: kindValue, check: checkWindow},
+}
+
+// checkField checks that the operand of exists and missing is a field.
+func checkField(c *compiler, path string, args []Node) {
+	if len(args) == 1 {
+		if _, ok := args[0].(*Ident); !ok {
+			c.errorf(path+"[1]", "expected a field")
+		}
+	}
+}
+
+// checkMatches checks that the pattern of matches is a string literal holding a valid regular expression.
+func checkMatches(c *compiler, path string, args []Node) {
+	if len(args) != 2 {
+		return
+	}
+	lit, ok := args[1].(*Literal)
+	if !ok {
+		c.errorf(path+"[2]", "matches expects a string literal pattern")
+		return
+	}
+	pattern, ok := lit.Value.(string)
+	if !ok {
+		c.errorf(path+"[2]", "matches expects a string literal pattern, got %v", lit.Value)
+		return
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		c.errorf(path+"[2]", "invalid pattern: %v", err)
+		return
+	}
+	if c.regexps == nil {
+		c.regexps = make(map[string]*regexp.Regexp)
+	}
+	c.regexps[pattern] = re
+}
+
+// CompileError is a problem found in an expression at compile time.
+type CompileError struct {
+	Path string // location of the offending node, e.g. $[2][1] is the first operand of the second operand of the root
+	Pos  Pos    // position of the offending node in the source, when compiled from text
+	Msg  string
+}
+
+func (e *CompileError) Error() string {
+	if e.Pos.IsValid() {
+		return fmt.Sprintf("%s: %s", e.Pos, e.Msg)
+	}
+	return fmt.Sprintf("%s: %s", e.Path, e.Msg)
+}
+
+// CompileErrors is the list of all problems found in an expression.
+type CompileErrors []*CompileError
+
+func (e CompileErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Program is an expression that has been validated and can be evaluated against events.
+type Program struct {
+	Root     Node
+	expr     Expression
+	expanded Expression // expr with its references expanded, see WithLibrary
+	cfg      *optconfig
+	ctx      context.Context // the context of Evaluate, holding cfg for functions
+	eval     condFn          // the closures evaluating the program
+	slots    int             // the number of wildcards bound by its any and all
+	frames   sync.Pool       // of *frame
+	regexps  map[string]*regexp.Regexp
+}
+
+// Compile validates the expression and returns a Program,
+// or CompileErrors listing every problem found in it,
+// or a LimitError if the expression exceeds its Limits.
+// The options apply to every evaluation of the program.
+func Compile(expr Expression, opts ...Option) (*Program, error) {
+	cfg := newConfig(opts)
+	expanded, err := cfg.expand(expr)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkLimits(expanded, cfg.limits); err != nil {
+		return nil, err
+	}
+	c := &compiler{windows: cfg.windows != nil}
+	root := c.compile("$", expanded, kindBool)
+	if len(c.errs) > 0 {
+		return nil, c.errs
+	}
+	p := &Program{Root: root, expr: expr, expanded: expanded, cfg: cfg, ctx: context.WithValue(context.Background(), configKey{}, cfg), regexps: c.regexps}
+	p.eval, p.slots = compileExec(root, p.cfg, c.regexps)
+	return p, nil
+}
+
+// CompileString parses an S expression and compiles it.
+// Errors carry the position of the offending node in s.
+func CompileString(s string, opts ...Option) (*Program, error) {
+	expr, positions, err := parse(s, newConfig(opts).limits)
+	if err != nil {
+		return nil, err
+	}
+	p, err := Compile(expr, opts...)
+	setPositions(err, positions)
+	return p, err
+}
+
+// setPositions sets the positions of the nodes errors are about from the positions of the parser.
+func setPositions(err error, positions map[string]Pos) {
+	switch err := err.(type) {
+	case CompileErrors:
+		for _, e := range err {
+			e.Pos = positions[e.Path]
+		}
+	case *LimitError:
+		err.Pos = positions[err.Path]
+	}
+}
+
+// Expression returns the expression the program was compiled from.
+func (p *Program) Expression() Expression {
+	return p.expr
+}
+
+// Evaluate evaluates the program against an event. It gives the same result as Evaluate,
+// but much faster, and without allocating unless the program calls functions or windowed aggregates or has a schema.
+// It is safe for concurrent use.
+func (p *Program) Evaluate(event map[string]interface{}) (bool, error) {
+	return p.evaluate(p.ctx, event)
+}
+
+// EvaluateContext is Evaluate, stopping with the error of ctx once it is done,
+// e.g. to bound the time spent evaluating a rule over large arrays of an event.
+// ctx is also passed to the functions the program calls.
+func (p *Program) EvaluateContext(ctx context.Context, event map[string]interface{}) (bool, error) {
+	return p.evaluate(context.WithValue(ctx, configKey{}, p.cfg), event)
+}
+
+func (p *Program) evaluate(ctx context.Context, event map[string]interface{}) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	if p.cfg.schema != nil {
+		typed, err := p.cfg.schema.Apply(event)
+		if err != nil {
+			return false, err
+		}
+		event = typed
+	}
+	f, ok := p.frames.Get().(*frame)
+	if !ok {
+		f = &frame{slots: make([]int, p.slots)}
+	}
+	f.ctx, f.event = ctx, event
+	result, err := p.eval(f)
+	f.ctx, f.event = nil, nil
+	p.frames.Put(f)
+	return result, err
+}
+
+type compiler struct {
+	errs    CompileErrors
+	bound   map[string]bool           // wildcard prefixes bound by the enclosing any and all
+	regexps map[string]*regexp.Regexp // the patterns of matches, compiled once with the program
+	windows bool                      // whether windowed aggregates have windows, see WithWindows
+}
+
+func (c *compiler) errorf(path string, format string, args ...interface{}) {
+	c.errs = append(c.errs, &CompileError{Path: path, Msg: fmt.Sprintf(format, args...)})
+}
+
+// compile converts expr into a Node, checking that it is of the wanted kind.
+// Errors are collected rather than returned, so that every problem is reported at once.
+func (c *compiler) compile(path string, expr Expression, want kind) Node {
+	switch e := expr.(type) {
+	case []interface{}:
+		if want == kindList {
+			return c.compileList(path, e)
+		}
+		return c.compileCall(path, e, want)
+	case Symbol:
+		if want == kindList {
+			c.errorf(path, "expected a list, got %s", e)
+		}
+		c.checkPath(path, string(e))
+		return &Ident{Name: string(e)}
+	case bool:
+		if want == kindList {
+			c.errorf(path, "expected a list, got %v", e)
+		}
+		return &Literal{Value: e}
+	case string, int, float64, nil:
+		if want != kindValue {
+			c.errorf(path, "expected a %s, got %#v", want, e)
+		}
+		return &Literal{Value: e}
+	default:
+		c.errorf(path, "invalid expression: %v", e)
+		return &Literal{Value: e}
+	}
+}
+
+func (c *compiler) compileCall(path string, e []interface{}, want kind) Node {
+	if len(e) == 0 {
+		c.errorf(path, "empty expression")
+		return &Call{}
+	}
+	sym, ok := e[0].(Symbol)
+	if !ok {
+		c.errorf(path, "invalid operator: %#v", e[0])
+		return &Call{}
+	}
+	name := string(sym)
+	if name == "ref" {
+		c.errorf(path, "ref needs a library of predicates, see WithLibrary")
+		return &Call{Op: name}
+	}
+	op, ok := operators[name]
+	if !ok {
+		return c.compileFuncCall(path, name, e[1:])
+	}
+	if op.result != want {
+		c.errorf(path, "%s is not a %s", name, want)
+	}
+
+	operands := e[1:]
+	if op.variadic {
+		if len(operands) < op.min {
+			c.errorf(path, "%s expects at least %d operand(s), got %d", name, op.min, len(operands))
+		}
+	} else if len(operands) != len(op.args) {
+		c.errorf(path, "%s expects %d operand(s), got %d", name, len(op.args), len(operands))
+	}
+
+	if name == "any" || name == "all" {
+		if len(operands) == 1 {
+			return c.compileQuantifier(path, name, operands[0])
+		}
+		return &Call{Op: name}
+	}
+
+	call := &Call{Op: name, Args: make([]Node, 0, len(operands))}
+	for i, operand := range operands {
+		k := op.args[len(op.args)-1]
+		if i < len(op.args) {
+			k = op.args[i]
+		} else if !op.variadic {
+			break
+		}
+		call.Args = append(call.Args, c.compile(fmt.Sprintf("%s[%d]", path, i+1), operand, k))
+	}
+	if op.check != nil {
+		op.check(c, path, call.Args)
+	}
+	return call
+}
+
+// compileFuncCall compiles a call to a registered function. Its result can be used
+// both as a value and as a condition, so it is only checked for being a bool at evaluation.
+func (c *compiler) compileFuncCall(path string, name string, operands []interface{}) Node {
+	f, ok := lookupFunc(name)
+	if !ok {
+		c.errorf(path, "unknown operator: %s", name)
+		return &Call{Op: name}
+	}
+	if len(operands) < f.minArgs || (f.maxArgs >= 0 && len(operands) > f.maxArgs) {
+		if f.minArgs == f.maxArgs {
+			c.errorf(path, "%s expects %d argument(s), got %d", name, f.minArgs, len(operands))
+		} else if f.maxArgs < 0 {
+			c.errorf(path, "%s expects at least %d argument(s), got %d", name, f.minArgs, len(operands))
+		} else {
+			c.errorf(path, "%s expects %d to %d arguments, got %d", name, f.minArgs, f.maxArgs, len(operands))
+		}
+	}
+	call := &Call{Op: name, Args: make([]Node, len(operands))}
+	for i, operand := range operands {
+		call.Args[i] = c.compile(fmt.Sprintf("%s[%d]", path, i+1), operand, kindValue)
+	}
+	if f.check != nil {
+		f.check(c, path, call.Args)
+	}
+	return call
+}
+
+// compileQuantifier compiles the condition of any or all with the wildcard it quantifies over bound.
+func (c *compiler) compileQuantifier(path string, name string, cond Expression) Node {
+	prefix, ok := quantifiedPrefix(cond, func(prefix string) bool { return c.bound[prefix] })
+	if !ok {
+		c.errorf(path, "%s needs a wildcard path such as items[*].price in its condition", name)
+	} else {
+		if c.bound == nil {
+			c.bound = make(map[string]bool)
+		}
+		c.bound[prefix] = true
+		defer delete(c.bound, prefix)
+	}
+	return &Call{Op: name, Args: []Node{c.compile(path+"[1]", cond, kindBool)}}
+}
+
+// checkPath checks that an identifier is a valid path whose wildcards are all bound by an enclosing any or all.
+func (c *compiler) checkPath(path string, name string) {
+	if !isPath(name) {
+		return
+	}
+	if _, err := parsePath(name); err != nil {
+		c.errorf(path, "%v", err)
+		return
+	}
+	for _, prefix := range wildcardPrefixes(name) {
+		if !c.bound[prefix] {
+			c.errorf(path, "wildcard %s must be used inside any or all", prefix)
+			return
+		}
+	}
+}
+
+func (c *compiler) compileList(path string, e []interface{}) Node {
+	list := &List{Items: make([]Node, 0, len(e))}
+	for i, item := range e {
+		switch item.(type) {
+		case string, int, float64, bool, nil:
+		default:
+			c.errorf(fmt.Sprintf("%s[%d]", path, i), "list items must be literals, got %v", item)
+		}
+		list.Items = append(list.Items, &Literal{Value: item})
+	}
+	return list
+}
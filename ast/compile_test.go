@@ -0,0 +1,64 @@
+package ast
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCompile(t *testing.T) {
+	p, err := CompileString(`(and (== age 20) (>= score 51) (in status ("active" "pending")))`)
+	if err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	root, ok := p.Root.(*Call)
+	if !ok || root.Op != "and" || len(root.Args) != 3 {
+		t.Fatalf("unexpected root: %#v", p.Root)
+	}
+	in := root.Args[2].(*Call)
+	if _, ok := in.Args[1].(*List); !ok {
+		t.Errorf("expected a list operand for in, got %#v", in.Args[1])
+	}
+
+	result, err := p.Evaluate(map[string]interface{}{"age": 20, "score": 60, "status": "active"})
+	if err != nil || !result {
+		t.Errorf("evaluate: got %v, %v", result, err)
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		expr  string
+		paths []string
+	}{
+		{`(foo a b)`, []string{"$"}},
+		{`(not a b)`, []string{"$"}},
+		{`(in status "active")`, []string{"$[2]"}},
+		{`(and (== a) (xor b c) (in c (1 (2))))`, []string{"$[1]", "$[2]", "$[3][2][1]"}},
+		{`(== a (and b c))`, []string{"$[2]"}},
+		{`(and 1)`, []string{"$[1]"}},
+		{`(== a 1)`, nil},
+	}
+	for _, tt := range tests {
+		_, err := CompileString(tt.expr)
+		if tt.paths == nil {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tt.expr, err)
+			}
+			continue
+		}
+		var errs CompileErrors
+		if !errors.As(err, &errs) {
+			t.Errorf("%s: expected CompileErrors, got %v", tt.expr, err)
+			continue
+		}
+		if len(errs) != len(tt.paths) {
+			t.Errorf("%s: expected %d errors, got %v", tt.expr, len(tt.paths), errs)
+			continue
+		}
+		for i, path := range tt.paths {
+			if errs[i].Path != path {
+				t.Errorf("%s: error %d: expected path %s, got %s", tt.expr, i, path, errs[i].Path)
+			}
+		}
+	}
+}
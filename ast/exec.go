@@ -0,0 +1,831 @@
+package ast
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+)
+
+// A compiled Program is evaluated by a tree of Go closures built from its nodes once, when it is compiled,
+// rather than by walking the expression for every event like Evaluate does. Literals are converted and
+// sub-expressions with constant operands folded ahead of time, paths are parsed, patterns compiled and
+// functions looked up, and values are passed around unboxed, so that evaluating a program does not
+// allocate unless it calls a function or a windowed aggregate, or applies a schema to the event.
+// The closures must give the same results and errors as the interpreter, which still backs Explain.
+
+// frame is the state of one evaluation of a program. Frames are pooled by their program.
+type frame struct {
+	ctx   context.Context // passed to functions, and checked for cancellation by any and all
+	event map[string]interface{}
+	slots []int // index of the element bound to each wildcard by an enclosing any or all
+}
+
+// context returns the context of the evaluation, or else, when folding constants at compile time, fallback.
+func (f *frame) context(fallback context.Context) context.Context {
+	if f == nil {
+		return fallback
+	}
+	return f.ctx
+}
+
+type (
+	condFn  func(f *frame) (bool, error)
+	valueFn func(f *frame) (value, error)
+)
+
+// cond is a compiled condition, whose result is known at compile time when isConst.
+type cond struct {
+	fn      condFn
+	isConst bool
+	c       bool
+}
+
+// val is a compiled value expression, whose value is known at compile time when isConst.
+type val struct {
+	fn      valueFn
+	isConst bool
+	c       value
+}
+
+type vkind uint8
+
+const (
+	vNull vkind = iota
+	vBool
+	vInt
+	vFloat // any Go number other than an int, converted to a float64 like toFloat does
+	vString
+	vOther // lists, objects and any other value, only held in v
+)
+
+// value is a value of an expression that does not need to be boxed in an interface.
+type value struct {
+	kind vkind
+	b    bool
+	i    int
+	f    float64
+	s    string
+	v    interface{} // the original value when it comes from the event or a literal, so it never needs to be boxed again
+}
+
+func fromInterface(v interface{}) value {
+	switch t := v.(type) {
+	case nil:
+		return value{}
+	case bool:
+		return value{kind: vBool, b: t, v: v}
+	case int:
+		return value{kind: vInt, i: t, v: v}
+	case string:
+		return value{kind: vString, s: t, v: v}
+	}
+	if f, ok := toFloat(v); ok {
+		return value{kind: vFloat, f: f, v: v}
+	}
+	return value{kind: vOther, v: v}
+}
+
+func (v value) interfaceValue() interface{} {
+	if v.v != nil {
+		return v.v
+	}
+	switch v.kind {
+	case vBool:
+		return v.b
+	case vInt:
+		return v.i
+	case vFloat:
+		return v.f
+	case vString:
+		return v.s
+	}
+	return nil
+}
+
+func (v value) number() (float64, bool) {
+	switch v.kind {
+	case vInt:
+		return float64(v.i), true
+	case vFloat:
+		return v.f, true
+	}
+	return 0, false
+}
+
+// typeName is the Go type of the value as printed by %T.
+func (v value) typeName() string {
+	if v.v != nil {
+		return fmt.Sprintf("%T", v.v)
+	}
+	switch v.kind {
+	case vBool:
+		return "bool"
+	case vInt:
+		return "int"
+	case vFloat:
+		return "float64"
+	case vString:
+		return "string"
+	}
+	return "<nil>"
+}
+
+// coerceValue is Coercion.coerce for unboxed values.
+func (c Coercion) coerceValue(a, b value) value {
+	if c != CoercionLenient || a.kind != vString {
+		return a
+	}
+	if b.kind == vInt || b.kind == vFloat {
+		if i, f, isInt, ok := parseNumeric(strings.TrimSpace(a.s)); ok {
+			if isInt {
+				return value{kind: vInt, i: i}
+			}
+			return value{kind: vFloat, f: f}
+		}
+	}
+	if b.kind == vBool {
+		if v, ok := parseBool(strings.TrimSpace(a.s)); ok {
+			return value{kind: vBool, b: v}
+		}
+	}
+	return a
+}
+
+// numberValue is Coercion.number for unboxed values.
+func (c Coercion) numberValue(v value) value {
+	if c != CoercionLenient || v.kind != vString {
+		return v
+	}
+	if i, f, isInt, ok := parseNumeric(strings.TrimSpace(v.s)); ok {
+		if isInt {
+			return value{kind: vInt, i: i}
+		}
+		return value{kind: vFloat, f: f}
+	}
+	return v
+}
+
+// equalValues is env.equal for unboxed values.
+func equalValues(c Coercion, a, b value) (bool, error) {
+	if a.kind == vNull || b.kind == vNull {
+		return a.kind == b.kind, nil
+	}
+	a, b = c.coerceValue(a, b), c.coerceValue(b, a)
+	if a.kind == vBool && b.kind == vBool {
+		return a.b == b.b, nil
+	}
+	cmp, err := compareValues(a, b)
+	return cmp == 0, err
+}
+
+// compareValues is compare for unboxed values.
+func compareValues(a, b value) (float64, error) {
+	if x, ok := a.number(); ok {
+		if y, ok := b.number(); ok {
+			return x - y, nil
+		}
+	}
+	if a.kind == vString && b.kind == vString {
+		return float64(strings.Compare(a.s, b.s)), nil
+	}
+	return 0, fmt.Errorf("unsupported types: %s and %s", a.typeName(), b.typeName())
+}
+
+// memberValues is env.member for unboxed values.
+func memberValues(c Coercion, v value, items []value) (bool, error) {
+	for _, item := range items {
+		eq, err := equalValues(c, v, item)
+		if err != nil {
+			return false, err
+		}
+		if eq {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// arithmeticValues is arithmetic for unboxed values.
+func arithmeticValues(op string, args []value) (value, error) {
+	ints := op != "/"
+	for _, arg := range args {
+		ints = ints && arg.kind == vInt
+	}
+	if ints {
+		if op == "-" && len(args) == 1 {
+			return value{kind: vInt, i: -args[0].i}, nil
+		}
+		result := args[0].i
+		for _, arg := range args[1:] {
+			switch op {
+			case "+":
+				result += arg.i
+			case "-":
+				result -= arg.i
+			case "*":
+				result *= arg.i
+			case "%":
+				if arg.i == 0 {
+					return value{}, errDivisionByZero
+				}
+				result %= arg.i
+			}
+		}
+		return value{kind: vInt, i: result}, nil
+	}
+
+	for _, arg := range args {
+		if _, ok := arg.number(); !ok {
+			return value{}, fmt.Errorf("%s expects numbers, got %s", op, arg.typeName())
+		}
+	}
+	result, _ := args[0].number()
+	if op == "-" && len(args) == 1 {
+		return value{kind: vFloat, f: -result}, nil
+	}
+	for _, arg := range args[1:] {
+		f, _ := arg.number()
+		switch op {
+		case "+":
+			result += f
+		case "-":
+			result -= f
+		case "*":
+			result *= f
+		case "/":
+			if f == 0 {
+				return value{}, errDivisionByZero
+			}
+			result /= f
+		case "%":
+			if f == 0 {
+				return value{}, errDivisionByZero
+			}
+			result = math.Mod(result, f)
+		}
+	}
+	return value{kind: vFloat, f: result}, nil
+}
+
+// execCompiler builds the closures of a program.
+type execCompiler struct {
+	cfg     *optconfig
+	ctx     context.Context // passed to functions
+	slots   map[string]int  // wildcard prefix -> slot of the element bound to it by an enclosing any or all
+	nslots  int
+	paths   map[*Call]string          // the path of every call in the expression, which windowed aggregates are located by
+	regexps map[string]*regexp.Regexp // the patterns of matches, compiled by checkMatches
+}
+
+// compileExec builds the closures evaluating root, and returns the number of wildcard slots they need.
+func compileExec(root Node, cfg *optconfig, regexps map[string]*regexp.Regexp) (condFn, int) {
+	c := newExecCompiler(root, cfg, regexps)
+	return c.cond(root).fn, c.nslots
+}
+
+// compileExecValue is compileExec for a value expression.
+func compileExecValue(root Node, cfg *optconfig, regexps map[string]*regexp.Regexp) (valueFn, int) {
+	c := newExecCompiler(root, cfg, regexps)
+	return c.value(root).fn, c.nslots
+}
+
+func newExecCompiler(root Node, cfg *optconfig, regexps map[string]*regexp.Regexp) *execCompiler {
+	c := &execCompiler{
+		cfg:     cfg,
+		regexps: regexps,
+		ctx:     context.WithValue(context.Background(), configKey{}, cfg),
+		slots:   make(map[string]int),
+		paths:   make(map[*Call]string),
+	}
+	nodePaths(root, "$", c.paths)
+	return c
+}
+
+func constCond(b bool) cond {
+	return cond{fn: func(*frame) (bool, error) { return b, nil }, isConst: true, c: b}
+}
+
+func constVal(v value) val {
+	return val{fn: func(*frame) (value, error) { return v, nil }, isConst: true, c: v}
+}
+
+// foldCond evaluates fn at compile time when its operands are constant.
+// An error is kept for evaluation, as sub-expressions skipped by short-circuit evaluation must not fail.
+func foldCond(fn condFn, isConst bool) cond {
+	if !isConst {
+		return cond{fn: fn}
+	}
+	result, err := fn(nil)
+	if err != nil {
+		return cond{fn: func(*frame) (bool, error) { return false, err }}
+	}
+	return constCond(result)
+}
+
+// foldVal evaluates fn at compile time when its operands are constant.
+func foldVal(fn valueFn, isConst bool) val {
+	if !isConst {
+		return val{fn: fn}
+	}
+	result, err := fn(nil)
+	if err != nil {
+		return val{fn: func(*frame) (value, error) { return value{}, err }}
+	}
+	return constVal(result)
+}
+
+func (c *execCompiler) cond(n Node) cond {
+	switch n := n.(type) {
+	case *Literal:
+		b, _ := n.Value.(bool)
+		return constCond(b)
+	case *Ident:
+		v := c.ident(n.Name).fn
+		return cond{fn: func(f *frame) (bool, error) {
+			x, err := v(f)
+			if err != nil {
+				return false, err
+			}
+			if x.kind == vBool {
+				return x.b, nil
+			}
+			return x.kind != vNull, nil
+		}}
+	case *Call:
+		return c.call(n)
+	}
+	return cond{fn: func(*frame) (bool, error) { return false, fmt.Errorf("invalid expression: %v", n) }}
+}
+
+func (c *execCompiler) call(n *Call) cond {
+	switch n.Op {
+	case "and", "or":
+		return c.logical(n.Op == "and", n.Args)
+	case "not":
+		a := c.cond(n.Args[0])
+		if a.isConst {
+			return constCond(!a.c)
+		}
+		return cond{fn: func(f *frame) (bool, error) {
+			result, err := a.fn(f)
+			if err != nil {
+				return false, err
+			}
+			return !result, nil
+		}}
+	case ">", "<", ">=", "<=", "==", "!=", "<>":
+		return c.comparison(n.Op, c.value(n.Args[0]), c.value(n.Args[1]))
+	case "between":
+		return c.between(c.value(n.Args[0]), c.value(n.Args[1]), c.value(n.Args[2]))
+	case "exists", "missing":
+		get := c.getter(n.Args[0].(*Ident).Name)
+		exists := n.Op == "exists"
+		return cond{fn: func(f *frame) (bool, error) {
+			_, found := get(f)
+			return found == exists, nil
+		}}
+	case "in", "not_in":
+		return c.in(n.Op == "in", c.value(n.Args[0]), n.Args[1].(*List))
+	case "contains", "starts_with", "ends_with", "ieq", "matches":
+		return c.stringOp(n.Op, c.value(n.Args[0]), n.Args[1])
+	case "any", "all":
+		return c.quantifier(n.Op == "all", n.Args[0])
+	}
+	call, f, isConst := c.funcCall(n)
+	return foldCond(func(fr *frame) (bool, error) {
+		result, err := call(fr)
+		if err != nil {
+			return false, err
+		}
+		b, ok := result.(bool)
+		if !ok {
+			return false, fmt.Errorf("%s returned %T, not a condition", n.Op, result)
+		}
+		return b, nil
+	}, isConst && f.pure)
+}
+
+// logical compiles and and or. Constant operands that do not decide the result are dropped,
+// and operands after one that does are never evaluated.
+func (c *execCompiler) logical(and bool, args []Node) cond {
+	var fns []condFn
+	for _, arg := range args {
+		a := c.cond(arg)
+		if a.isConst && a.c == and {
+			continue
+		}
+		if a.isConst && len(fns) == 0 {
+			return constCond(!and)
+		}
+		fns = append(fns, a.fn)
+		if a.isConst {
+			break
+		}
+	}
+	switch len(fns) {
+	case 0:
+		return constCond(and)
+	case 1:
+		return cond{fn: fns[0]}
+	}
+	return cond{fn: func(f *frame) (bool, error) {
+		for _, fn := range fns {
+			result, err := fn(f)
+			if err != nil {
+				return false, err
+			}
+			if result != and {
+				return result, nil
+			}
+		}
+		return and, nil
+	}}
+}
+
+func (c *execCompiler) comparison(op string, a, b val) cond {
+	coercion := c.cfg.coercion
+	var fn condFn
+	switch op {
+	case "==", "!=", "<>":
+		eq := op == "=="
+		fn = func(f *frame) (bool, error) {
+			x, err := a.fn(f)
+			if err != nil {
+				return false, err
+			}
+			y, err := b.fn(f)
+			if err != nil {
+				return false, err
+			}
+			result, err := equalValues(coercion, x, y)
+			if err != nil {
+				return false, err
+			}
+			return result == eq, nil
+		}
+	default:
+		test := orderTest(op)
+		fn = func(f *frame) (bool, error) {
+			x, err := a.fn(f)
+			if err != nil {
+				return false, err
+			}
+			y, err := b.fn(f)
+			if err != nil {
+				return false, err
+			}
+			if x.kind == vNull || y.kind == vNull {
+				return false, nil
+			}
+			cmp, err := compareValues(coercion.coerceValue(x, y), coercion.coerceValue(y, x))
+			if err != nil {
+				return false, err
+			}
+			return test(cmp), nil
+		}
+	}
+	return foldCond(fn, a.isConst && b.isConst)
+}
+
+func orderTest(op string) func(cmp float64) bool {
+	switch op {
+	case ">":
+		return func(cmp float64) bool { return cmp > 0 }
+	case "<":
+		return func(cmp float64) bool { return cmp < 0 }
+	case ">=":
+		return func(cmp float64) bool { return cmp >= 0 }
+	}
+	return func(cmp float64) bool { return cmp <= 0 }
+}
+
+func (c *execCompiler) between(a, low, high val) cond {
+	coercion := c.cfg.coercion
+	return foldCond(func(f *frame) (bool, error) {
+		x, err := a.fn(f)
+		if err != nil {
+			return false, err
+		}
+		lo, err := low.fn(f)
+		if err != nil {
+			return false, err
+		}
+		hi, err := high.fn(f)
+		if err != nil {
+			return false, err
+		}
+		if x.kind == vNull || lo.kind == vNull || hi.kind == vNull {
+			return false, nil
+		}
+		cmp, err := compareValues(coercion.coerceValue(x, lo), coercion.coerceValue(lo, x))
+		if err != nil {
+			return false, err
+		}
+		cmpHigh, err := compareValues(coercion.coerceValue(x, hi), coercion.coerceValue(hi, x))
+		if err != nil {
+			return false, err
+		}
+		return cmp >= 0 && cmpHigh <= 0, nil
+	}, a.isConst && low.isConst && high.isConst)
+}
+
+// in compiles in and not_in. A list of strings is looked up in a set when the value is a string,
+// which gives the same result as comparing it to every item.
+func (c *execCompiler) in(in bool, a val, list *List) cond {
+	coercion := c.cfg.coercion
+	items := make([]value, len(list.Items))
+	var set map[string]struct{}
+	for i, item := range list.Items {
+		items[i] = fromInterface(item.(*Literal).Value)
+	}
+	if len(items) > 0 && allStrings(items) {
+		set = make(map[string]struct{}, len(items))
+		for _, item := range items {
+			set[item.s] = struct{}{}
+		}
+	}
+	return foldCond(func(f *frame) (bool, error) {
+		x, err := a.fn(f)
+		if err != nil {
+			return false, err
+		}
+		if set != nil && x.kind == vString {
+			_, found := set[x.s]
+			return found == in, nil
+		}
+		found, err := memberValues(coercion, x, items)
+		if err != nil {
+			return false, err
+		}
+		return found == in, nil
+	}, a.isConst)
+}
+
+func allStrings(values []value) bool {
+	for _, v := range values {
+		if v.kind != vString {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *execCompiler) stringOp(op string, a val, arg Node) cond {
+	coercion := c.cfg.coercion
+	b := c.value(arg)
+	var re *regexp.Regexp
+	if op == "matches" {
+		// the pattern is a valid string literal, checked by checkMatches
+		re = c.regexps[arg.(*Literal).Value.(string)]
+	}
+	return foldCond(func(f *frame) (bool, error) {
+		x, err := a.fn(f)
+		if err != nil {
+			return false, err
+		}
+		y, err := b.fn(f)
+		if err != nil {
+			return false, err
+		}
+		if x.kind == vNull || y.kind == vNull {
+			return false, nil
+		}
+		if list, ok := x.v.([]interface{}); ok && op == "contains" {
+			for _, item := range list {
+				eq, err := equalValues(coercion, y, fromInterface(item))
+				if err != nil {
+					return false, err
+				}
+				if eq {
+					return true, nil
+				}
+			}
+			return false, nil
+		}
+		if x.kind != vString || y.kind != vString {
+			return false, fmt.Errorf("%s expects strings, got %s and %s", op, x.typeName(), y.typeName())
+		}
+		switch op {
+		case "contains":
+			return strings.Contains(x.s, y.s), nil
+		case "starts_with":
+			return strings.HasPrefix(x.s, y.s), nil
+		case "ends_with":
+			return strings.HasSuffix(x.s, y.s), nil
+		case "ieq":
+			return strings.EqualFold(x.s, y.s), nil
+		}
+		return re.MatchString(x.s), nil
+	}, a.isConst && b.isConst)
+}
+
+// quantifier compiles any and all, binding the wildcard they quantify over to a slot of the frame.
+func (c *execCompiler) quantifier(all bool, arg Node) cond {
+	prefix, _ := nodePrefix(arg, func(prefix string) bool {
+		_, bound := c.slots[prefix]
+		return bound
+	})
+	collection := c.getter(strings.TrimSuffix(prefix, "[*]"))
+	slot := c.nslots
+	c.nslots++
+	c.slots[prefix] = slot
+	body := c.cond(arg).fn
+	delete(c.slots, prefix)
+	return cond{fn: func(f *frame) (bool, error) {
+		v, _ := collection(f)
+		items, _ := v.([]interface{})
+		for i := range items {
+			if err := f.ctx.Err(); err != nil {
+				return false, err
+			}
+			f.slots[slot] = i
+			result, err := body(f)
+			if err != nil {
+				return false, err
+			}
+			if result != all {
+				return result, nil
+			}
+		}
+		return all, nil
+	}}
+}
+
+// nodePrefix is quantifiedPrefix for compiled nodes.
+func nodePrefix(n Node, bound func(prefix string) bool) (string, bool) {
+	switch n := n.(type) {
+	case *Call:
+		for _, arg := range n.Args {
+			if prefix, ok := nodePrefix(arg, bound); ok {
+				return prefix, true
+			}
+		}
+	case *Ident:
+		for _, prefix := range wildcardPrefixes(n.Name) {
+			if !bound(prefix) {
+				return prefix, true
+			}
+		}
+	}
+	return "", false
+}
+
+func (c *execCompiler) value(n Node) val {
+	switch n := n.(type) {
+	case *Literal:
+		return constVal(fromInterface(n.Value))
+	case *Ident:
+		return c.ident(n.Name)
+	case *Call:
+		if isArithmetic(Symbol(n.Op)) {
+			return c.arithmetic(n.Op, n.Args)
+		}
+		if isWindow(n.Op) {
+			return c.window(n)
+		}
+		call, f, isConst := c.funcCall(n)
+		return foldVal(func(fr *frame) (value, error) {
+			result, err := call(fr)
+			if err != nil {
+				return value{}, err
+			}
+			return fromInterface(result), nil
+		}, isConst && f.pure)
+	}
+	return val{fn: func(*frame) (value, error) { return value{}, fmt.Errorf("%v is not a value", n) }}
+}
+
+func (c *execCompiler) ident(name string) val {
+	get := c.getter(name)
+	return val{fn: func(f *frame) (value, error) {
+		v, _ := get(f)
+		return fromInterface(v), nil
+	}}
+}
+
+// step is a segment of a path, with its wildcard resolved to a slot of the frame.
+type step struct {
+	pathSegment
+	slot int
+}
+
+// getter returns a function resolving a field like lookup does, with the path parsed ahead of time.
+func (c *execCompiler) getter(name string) func(f *frame) (interface{}, bool) {
+	if !isPath(name) {
+		return func(f *frame) (interface{}, bool) {
+			v, ok := f.event[name]
+			return v, ok
+		}
+	}
+	segments, _ := parsePath(name) // checked by checkPath
+	steps := make([]step, len(segments))
+	for i, seg := range segments {
+		steps[i] = step{pathSegment: seg}
+		if seg.wildcard {
+			steps[i].slot = c.slots[name[:seg.end]]
+		}
+	}
+	return func(f *frame) (interface{}, bool) {
+		if v, ok := f.event[name]; ok {
+			return v, true
+		}
+		var current interface{} = f.event
+		for i := range steps {
+			var ok bool
+			switch s := &steps[i]; {
+			case s.wildcard:
+				current, ok = elementAt(current, f.slots[s.slot])
+			case s.isIndex:
+				current, ok = elementAt(current, s.index)
+			default:
+				current, ok = fieldOf(current, s.key)
+			}
+			if !ok {
+				return nil, false
+			}
+		}
+		return current, true
+	}
+}
+
+// maxStackArgs is the number of operands of an arithmetic operation evaluated without allocating.
+const maxStackArgs = 4
+
+func (c *execCompiler) arithmetic(op string, args []Node) val {
+	coercion := c.cfg.coercion
+	fns := make([]valueFn, len(args))
+	isConst := true
+	for i, arg := range args {
+		a := c.value(arg)
+		fns[i] = a.fn
+		isConst = isConst && a.isConst
+	}
+	return foldVal(func(f *frame) (value, error) {
+		var buf [maxStackArgs]value
+		values := buf[:0]
+		for _, fn := range fns {
+			v, err := fn(f)
+			if err != nil {
+				return value{}, err
+			}
+			values = append(values, v)
+		}
+		for i := range values {
+			if values[i].kind == vNull {
+				return value{}, nil
+			}
+			values[i] = coercion.numberValue(values[i])
+		}
+		return arithmeticValues(op, values)
+	}, isConst)
+}
+
+// window compiles a windowed aggregate, which records the event in its window every time it is evaluated.
+func (c *execCompiler) window(n *Call) val {
+	cfg, ctx, path := c.cfg, c.ctx, c.paths[n]
+	fns := make([]valueFn, len(n.Args))
+	for i, arg := range n.Args {
+		fns[i] = c.value(arg).fn
+	}
+	return val{fn: func(f *frame) (value, error) {
+		args := make([]interface{}, len(fns))
+		for i, fn := range fns {
+			v, err := fn(f)
+			if err != nil {
+				return value{}, err
+			}
+			args[i] = v.interfaceValue()
+		}
+		result, err := windowAggregate(f.context(ctx), cfg, n.Op, path, args)
+		if err != nil {
+			return value{}, err
+		}
+		return fromInterface(result), nil
+	}}
+}
+
+// funcCall compiles a call to a registered function, which is passed boxed arguments.
+func (c *execCompiler) funcCall(n *Call) (func(f *frame) (interface{}, error), *function, bool) {
+	f, _ := lookupFunc(n.Op) // checked by compileFuncCall
+	ctx := c.ctx
+	fns := make([]valueFn, len(n.Args))
+	isConst := true
+	for i, arg := range n.Args {
+		a := c.value(arg)
+		fns[i] = a.fn
+		isConst = isConst && a.isConst
+	}
+	return func(fr *frame) (interface{}, error) {
+		args := make([]interface{}, len(fns))
+		for i, fn := range fns {
+			v, err := fn(fr)
+			if err != nil {
+				return nil, err
+			}
+			args[i] = v.interfaceValue()
+		}
+		return f.fn(fr.context(ctx), args...)
+	}, f, isConst
+}
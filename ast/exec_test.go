@@ -0,0 +1,145 @@
+package ast
+
+import (
+	"testing"
+	"time"
+)
+
+// TestProgramMatchesInterpreter checks that compiled programs give the same results and errors as Evaluate.
+func TestProgramMatchesInterpreter(t *testing.T) {
+	events := []map[string]interface{}{
+		{},
+		{
+			"age": 20, "score": "51", "ratio": 0.5, "big": int64(1) << 40, "status": "active", "vip": true,
+			"flag": "true", "bad": "abc", "empty": nil, "country": "DE", "email": "ops@example.com",
+			"tags":  []interface{}{"sale", "new", 3},
+			"user":  map[string]interface{}{"address": map[string]interface{}{"city": "Berlin"}},
+			"items": []interface{}{map[string]interface{}{"price": 5, "sku": "a"}, map[string]interface{}{"price": "12.5", "sku": "b"}},
+			"orders": []interface{}{
+				map[string]interface{}{"items": []interface{}{map[string]interface{}{"qty": 1}}},
+				map[string]interface{}{"items": []interface{}{}},
+			},
+			"user.name": "flat", "ts": int64(1700000000000),
+		},
+		{"age": "20", "score": 51.0, "status": 1, "vip": "no", "tags": "sale", "items": "none", "bad": []interface{}{}},
+	}
+	exprs := []string{
+		`(== age 20)`, `(!= age 20)`, `(<> age "20")`, `(> score 50)`, `(<= score 51)`, `(< ratio 1)`,
+		`(>= big 1000)`, `(== score "51")`, `(> status "a")`, `(== bad 1)`, `(< bad 1)`, `(== vip true)`,
+		`(== flag true)`, `(== empty null)`, `(!= missing_field null)`, `(> missing_field 1)`,
+		`(and (== age 20) (> score 50) (in status ("active" "pending")))`, `(or (== age 1) (== age 20))`,
+		`(not (== age 20))`, `(and true (== age 20))`, `(and (== age 20) false (== bad 1))`, `(or false vip)`,
+		`(and (== bad 1) false)`, `(or true (== bad 1))`, `(not false)`, `vip`, `empty`, `status`, `true`,
+		`(in age (20 30))`, `(in age ("20" "x"))`, `(in status ("active" 1))`, `(in bad (1 2))`,
+		`(not_in country ("DE" "FR"))`, `(in empty (null))`, `(in missing_field ("a"))`,
+		`(contains tags "new")`, `(contains tags 3)`, `(contains tags "3")`, `(contains email "example")`,
+		`(contains age "2")`, `(starts_with email "ops")`, `(ends_with email ".com")`, `(ieq country "de")`,
+		`(matches email "^[a-z]+@")`, `(contains empty "x")`, `(between age 18 30)`, `(between score "50" 60)`,
+		`(between bad 1 2)`, `(between empty 1 2)`, `(exists age)`, `(missing age)`, `(exists user.address.city)`,
+		`(exists empty)`, `(== user.address.city "Berlin")`, `(== user.name "flat")`, `(== items[0].sku "a")`,
+		`(== items[-1].price 12.5)`, `(missing items[5])`, `(any (> items[*].price 10))`,
+		`(all (> items[*].price 1))`, `(all (> items[*].price 10))`, `(any (== items[*].price "x"))`,
+		`(any (any (== orders[*].items[*].qty 1)))`, `(all (any (== orders[*].items[*].qty 1)))`,
+		`(== (+ age 1) 21)`, `(== (- age) -20)`, `(== (* score 2) 102)`, `(== (/ age 8) 2.5)`, `(== (% age 7) 6)`,
+		`(== (% ratio 0) 1)`, `(== (/ age 0) 1)`, `(== (+ age bad) 1)`, `(== (+ age empty) null)`,
+		`(== (+ 1 2 3 4 5 6) 21)`, `(== (+ big 1) 1099511627777)`, `(> (- score age) 30)`, `(== (+ 1 2) 3)`,
+		`(and (== age 1) (== (/ 1 0) 1))`, `(== (lower country) "de")`, `(== (len tags) 3)`, `(== (len email) 15)`,
+		`(== (upper "x") "X")`, `(== (abs (- age)) 20)`, `(== (round ratio) 1)`, `(== (coalesce empty age) 20)`,
+		`(within_last ts "1h")`, `(business_hours ts)`, `(== (hour_of_day ts) 22)`, `(== (day_of_week ts) 2)`,
+		`(lower country)`, `(< (now) 0)`,
+	}
+	clock := ClockFunc(func() time.Time { return time.UnixMilli(1700000000000 + 60000) })
+	for _, coercion := range []Coercion{CoercionLenient, CoercionStrict} {
+		for _, s := range exprs {
+			expr, err := ParseExpression(s)
+			if err != nil {
+				t.Fatalf("%s: %v", s, err)
+			}
+			opts := []Option{WithCoercion(coercion), WithClock(clock)}
+			p, err := Compile(expr, opts...)
+			if err != nil {
+				t.Fatalf("%s: compile: %v", s, err)
+			}
+			for i, event := range events {
+				want, wantErr := Evaluate(expr, event, opts...)
+				got, gotErr := p.Evaluate(event)
+				switch {
+				case (gotErr == nil) != (wantErr == nil):
+					t.Errorf("%s on event %d (%s): got error %v, want %v", s, i, coercion, gotErr, wantErr)
+				case gotErr != nil && gotErr.Error() != wantErr.Error():
+					t.Errorf("%s on event %d (%s): got error %q, want %q", s, i, coercion, gotErr, wantErr)
+				case gotErr == nil && got != want:
+					t.Errorf("%s on event %d (%s): got %v, want %v", s, i, coercion, got, want)
+				}
+			}
+		}
+	}
+}
+
+var benchEvent = map[string]interface{}{
+	"age":     20,
+	"score":   "51",
+	"status":  "active",
+	"country": "DE",
+	"user":    map[string]interface{}{"tier": "gold"},
+	"items":   []interface{}{map[string]interface{}{"price": 5}, map[string]interface{}{"price": 120}},
+}
+
+const benchRule = `(and (== age 20) (> score 50) (in status ("active" "pending")) (not_in country ("US" "CA"))
+	(== user.tier "gold") (any (> items[*].price (* 10 10))))`
+
+func TestProgramDoesNotAllocate(t *testing.T) {
+	p, err := CompileString(benchRule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		if ok, err := p.Evaluate(benchEvent); !ok || err != nil {
+			t.Fatalf("got %v, %v", ok, err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("got %v allocations per evaluation, want 0", allocs)
+	}
+}
+
+func BenchmarkEvaluate(b *testing.B) {
+	expr, err := ParseExpression(benchRule)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := Evaluate(expr, benchEvent); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkProgramEvaluate(b *testing.B) {
+	p, err := CompileString(benchRule)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := p.Evaluate(benchEvent); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkProgramEvaluateParallel(b *testing.B) {
+	p, err := CompileString(benchRule)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := p.Evaluate(benchEvent); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,109 @@
+package ast
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Trace explains the evaluation of an expression: every sub-expression that was evaluated,
+// the values its operands resolved to and its result. Sub-expressions that were skipped
+// by short-circuit evaluation of and, or, any and all are not in the trace.
+type Trace struct {
+	Expr     string        `json:"expr"`               // the sub-expression as an S expression
+	Operands []interface{} `json:"operands,omitempty"` // the values of its value operands, in order
+	Result   interface{}   `json:"result"`             // a bool for conditions, or the value of a value expression
+	Error    string        `json:"error,omitempty"`
+	Children []*Trace      `json:"children,omitempty"` // the traces of its sub-expressions
+	parent   *Trace
+}
+
+// Explain evaluates expr against the event like Evaluate, and returns the trace of the evaluation.
+// The trace is returned even when the evaluation fails, up to the failing sub-expression.
+func Explain(expr Expression, event map[string]interface{}, opts ...Option) (*Trace, error) {
+	cfg := newConfig(opts)
+	expr, err := cfg.expand(expr)
+	if err != nil {
+		return nil, err
+	}
+	return explain(context.Background(), expr, event, cfg, nil)
+}
+
+// Explain evaluates the program against an event and returns the trace of the evaluation.
+func (p *Program) Explain(event map[string]interface{}) (*Trace, error) {
+	return p.ExplainContext(context.Background(), event)
+}
+
+// ExplainContext is Explain, stopping with the error of ctx once it is done.
+func (p *Program) ExplainContext(ctx context.Context, event map[string]interface{}) (*Trace, error) {
+	return explain(ctx, p.expanded, event, p.cfg, p.regexps)
+}
+
+func explain(ctx context.Context, expr Expression, event map[string]interface{}, cfg *optconfig, regexps map[string]*regexp.Regexp) (*Trace, error) {
+	env, err := newEnv(ctx, expr, event, cfg)
+	if err != nil {
+		return nil, err
+	}
+	env.regexps = regexps
+	root := &Trace{}
+	env.trace = root
+	_, err = env.evaluate(expr)
+	return root.Children[0], err
+}
+
+// enter starts the trace of a sub-expression.
+func (env *env) enter(expr Expression) *Trace {
+	s, err := FormatSExpr(expr)
+	if err != nil {
+		s = fmt.Sprint(expr)
+	}
+	t := &Trace{Expr: s, parent: env.trace}
+	env.trace.Children = append(env.trace.Children, t)
+	env.trace = t
+	return t
+}
+
+// leave ends the trace of a sub-expression with its result.
+func (env *env) leave(t *Trace, result interface{}, err error) {
+	t.Result = result
+	if err != nil {
+		t.Error = err.Error()
+	}
+	env.trace = t.parent
+}
+
+// String formats the trace as an indented tree, one sub-expression per line.
+func (t *Trace) String() string {
+	var sb strings.Builder
+	t.format(&sb, 0)
+	return sb.String()
+}
+
+func (t *Trace) format(sb *strings.Builder, depth int) {
+	sb.WriteString(strings.Repeat("  ", depth))
+	sb.WriteString(t.Expr)
+	if len(t.Operands) > 0 {
+		operands := make([]string, len(t.Operands))
+		for i, v := range t.Operands {
+			operands[i] = formatValue(v)
+		}
+		fmt.Fprintf(sb, " with %s", strings.Join(operands, ", "))
+	}
+	if t.Error != "" {
+		fmt.Fprintf(sb, " => error: %s", t.Error)
+	} else {
+		fmt.Fprintf(sb, " => %s", formatValue(t.Result))
+	}
+	sb.WriteByte('\n')
+	for _, child := range t.Children {
+		child.format(sb, depth+1)
+	}
+}
+
+func formatValue(v interface{}) string {
+	if s, err := formatLiteral(v); err == nil {
+		return s
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,83 @@
+package ast
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestExplain(t *testing.T) {
+	p, err := CompileString(`(and (== (lower country) "de") (>= score 51) (in status ("active" "pending")))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trace, err := p.Explain(FromProperties(map[string]string{"country": "DE", "score": "50", "status": "active"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if trace.Result != false || len(trace.Children) != 2 {
+		t.Fatalf("expected and to be false after 2 operands, got %s", trace)
+	}
+	eq := trace.Children[0]
+	if eq.Result != true || len(eq.Operands) != 2 || eq.Operands[0] != "de" || eq.Operands[1] != "de" {
+		t.Errorf("unexpected trace of ==: %#v", eq)
+	}
+	if len(eq.Children) != 1 || eq.Children[0].Expr != "(lower country)" || eq.Children[0].Operands[0] != "DE" {
+		t.Errorf("unexpected trace of lower: %#v", eq.Children)
+	}
+	ge := trace.Children[1]
+	if ge.Expr != "(>= score 51)" || ge.Result != false || ge.Operands[0] != "50" {
+		t.Errorf("unexpected trace of >=: %#v", ge)
+	}
+
+	data, err := json.Marshal(trace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"operands":["50",51],"result":false`) {
+		t.Errorf("unexpected JSON: %s", data)
+	}
+	if !strings.Contains(trace.String(), "  (>= score 51) with \"50\", 51 => false\n") {
+		t.Errorf("unexpected string:\n%s", trace)
+	}
+}
+
+func TestExplainError(t *testing.T) {
+	expr, err := ParseExpression(`(or (== a 1) (> b 2))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trace, err := Explain(expr, map[string]interface{}{"a": 2, "b": "x"})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if len(trace.Children) != 2 || trace.Children[1].Error == "" {
+		t.Errorf("expected the error in the trace, got %s", trace)
+	}
+}
+
+func TestExplainEqualError(t *testing.T) {
+	event := map[string]interface{}{"s": "x"}
+	for _, s := range []string{`(== s 10)`, `(!= s 10)`} {
+		expr, err := ParseExpression(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := Compile(expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ok, err := p.Evaluate(event)
+		if err == nil || ok {
+			t.Errorf("%s: Evaluate got %v, %v, want false and an error", s, ok, err)
+		}
+		if ok, err := Evaluate(expr, event); err == nil || ok {
+			t.Errorf("%s: interpreter got %v, %v, want false and an error", s, ok, err)
+		}
+		trace, err := p.Explain(event)
+		if err == nil || trace.Result != false {
+			t.Errorf("%s: Explain got %v, %v, want false and an error", s, trace.Result, err)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package ast
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// FormatSExpr formats an expression as an S expression, which ParseExpression parses back to the same expression.
+func FormatSExpr(expr Expression) (string, error) {
+	var sb strings.Builder
+	if err := formatSExpr(&sb, expr); err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
+
+func formatSExpr(sb *strings.Builder, expr Expression) error {
+	switch e := expr.(type) {
+	case []interface{}:
+		sb.WriteByte('(')
+		for i, item := range e {
+			if i > 0 {
+				sb.WriteByte(' ')
+			}
+			if err := formatSExpr(sb, item); err != nil {
+				return err
+			}
+		}
+		sb.WriteByte(')')
+		return nil
+	case Symbol:
+		if !isSExprSymbol(string(e)) {
+			return fmt.Errorf("%q cannot be written as a symbol of an S expression", string(e))
+		}
+		sb.WriteString(string(e))
+		return nil
+	default:
+		s, err := formatLiteral(e)
+		if err != nil {
+			return err
+		}
+		sb.WriteString(s)
+		return nil
+	}
+}
+
+func isSExprSymbol(s string) bool {
+	if s == "" || looksNumeric(s) || s == "true" || s == "false" || s == "null" {
+		return false
+	}
+	for _, r := range s {
+		if isDelimiter(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// FormatInfix formats an expression in infix syntax, which ParseInfix parses back to the same expression.
+func FormatInfix(expr Expression) (string, error) {
+	return formatInfix(expr, precOr)
+}
+
+// formatInfix formats expr, in parentheses if its precedence is lower than prec.
+func formatInfix(expr Expression, prec int) (string, error) {
+	switch e := expr.(type) {
+	case []interface{}:
+		if len(e) > 0 {
+			if op, ok := e[0].(Symbol); ok {
+				s, own, err := formatInfixCall(string(op), e[1:])
+				if err != nil {
+					return "", err
+				}
+				if own < prec {
+					return "(" + s + ")", nil
+				}
+				return s, nil
+			}
+		}
+		items, err := formatInfixList(e, precOr)
+		if err != nil {
+			return "", err
+		}
+		return "[" + items + "]", nil
+	case Symbol:
+		if isInfixIdent(string(e)) {
+			return string(e), nil
+		}
+		if e == "" || strings.ContainsRune(string(e), '`') {
+			return "", fmt.Errorf("%q cannot be written as an identifier", string(e))
+		}
+		return "`" + string(e) + "`", nil
+	default:
+		return formatLiteral(e)
+	}
+}
+
+// formatInfixCall formats a call and returns its precedence.
+func formatInfixCall(op string, args []interface{}) (string, int, error) {
+	binary := func(sep string, prec int) (string, int, error) {
+		parts := make([]string, len(args))
+		for i, arg := range args {
+			s, err := formatInfix(arg, prec+1)
+			if err != nil {
+				return "", 0, err
+			}
+			parts[i] = s
+		}
+		return strings.Join(parts, sep), prec, nil
+	}
+
+	switch {
+	case (op == "and" || op == "or") && len(args) >= 2:
+		if op == "and" {
+			return binary(" && ", precAnd)
+		}
+		return binary(" || ", precOr)
+	case op == "not" && len(args) == 1:
+		s, err := formatInfix(args[0], precPrimary)
+		return "!" + s, precNot, err
+	case op == "in" || op == "not_in":
+		if list, ok := args[len(args)-1].([]interface{}); ok && len(args) == 2 && !isCall(list) {
+			left, err := formatInfix(args[0], precCompare+1)
+			if err != nil {
+				return "", 0, err
+			}
+			right, err := formatInfix(list, precCompare+1)
+			if err != nil {
+				return "", 0, err
+			}
+			if op == "not_in" {
+				return left + " not in " + right, precCompare, nil
+			}
+			return left + " in " + right, precCompare, nil
+		}
+	case op == "-" && len(args) == 1:
+		s, err := formatInfix(args[0], precUnary)
+		if err != nil {
+			return "", 0, err
+		}
+		if strings.HasPrefix(s, "-") || isNumber(args[0]) {
+			s = "(" + s + ")"
+		}
+		return "-" + s, precUnary, nil
+	case len(args) == 2 || (len(args) > 2 && (op == "+" || op == "-" || op == "*")):
+		if info, ok := infixOperators[op]; ok && info.op == op && info.prec >= precCompare {
+			return binary(" "+op+" ", info.prec)
+		}
+	}
+
+	if !isInfixIdent(op) && !isInfixKeyword(op) {
+		return "", 0, fmt.Errorf("%s with %d operand(s) cannot be written in infix syntax", op, len(args))
+	}
+	s, err := formatInfixList(args, precOr)
+	return op + "(" + s + ")", precPrimary, err
+}
+
+func formatInfixList(items []interface{}, prec int) (string, error) {
+	parts := make([]string, len(items))
+	for i, item := range items {
+		s, err := formatInfix(item, prec)
+		if err != nil {
+			return "", err
+		}
+		parts[i] = s
+	}
+	return strings.Join(parts, ", "), nil
+}
+
+func isCall(e []interface{}) bool {
+	if len(e) == 0 {
+		return false
+	}
+	_, ok := e[0].(Symbol)
+	return ok
+}
+
+func isNumber(v interface{}) bool {
+	_, ok := toFloat(v)
+	return ok
+}
+
+func isInfixKeyword(s string) bool {
+	_, ok := infixOperators[s]
+	return ok || s == "not" || s == "true" || s == "false" || s == "null"
+}
+
+// isInfixIdent reports whether s can be written as a plain identifier in infix syntax.
+func isInfixIdent(s string) bool {
+	if s == "" || isInfixKeyword(s) || !(s[0] == '_' || s[0] >= 'a' && s[0] <= 'z' || s[0] >= 'A' && s[0] <= 'Z') {
+		return false
+	}
+	l := newLexer(s)
+	l.lexPath()
+	return l.eof()
+}
+
+// formatLiteral formats a literal as it is written in both syntaxes.
+func formatLiteral(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "null", nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case string:
+		return quote(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case float64:
+		if math.IsInf(v, 0) || math.IsNaN(v) {
+			return "", fmt.Errorf("%v cannot be written as a number", v)
+		}
+		s := strconv.FormatFloat(v, 'g', -1, 64)
+		if !strings.ContainsAny(s, ".e") {
+			s += ".0" // keep it a float64 when parsed back
+		}
+		return s, nil
+	}
+	return "", fmt.Errorf("%v (%T) cannot be written as a literal", v, v)
+}
+
+func quote(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			sb.WriteString(`\"`)
+		case '\\':
+			sb.WriteString(`\\`)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\t':
+			sb.WriteString(`\t`)
+		case '\r':
+			sb.WriteString(`\r`)
+		default:
+			if r < 0x20 {
+				fmt.Fprintf(&sb, `\u%04x`, r)
+			} else {
+				sb.WriteRune(r)
+			}
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
@@ -0,0 +1,161 @@
+package ast
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Func is a Go function that can be called from expressions, e.g. (lower country).
+// A function that returns a bool can also be used as a condition, e.g. (and (is_vip user_id) (> amount 100)).
+// The built-in functions return null when their first argument is null, as it is when a field is missing.
+type Func func(ctx context.Context, args ...interface{}) (interface{}, error)
+
+type function struct {
+	fn      Func
+	minArgs int
+	maxArgs int                                         // maxArgs < 0 means variadic
+	check   func(c *compiler, path string, args []Node) // optional validation of the compiled arguments
+	pure    bool                                        // the result only depends on the arguments, so calls with constant arguments can be folded
+}
+
+var (
+	funcs   = make(map[string]*function)
+	funcsMu sync.RWMutex
+)
+
+func init() {
+	RegisterFunc("len", 1, 1, funcLen)
+	RegisterFunc("lower", 1, 1, funcLower)
+	RegisterFunc("upper", 1, 1, funcUpper)
+	RegisterFunc("abs", 1, 1, funcAbs)
+	RegisterFunc("round", 1, 2, funcRound)
+	RegisterFunc("coalesce", 1, -1, funcCoalesce)
+	RegisterFunc("now", 0, 0, funcNow)
+	for _, name := range []string{"len", "lower", "upper", "abs", "round", "coalesce"} {
+		funcs[name].pure = true
+	}
+}
+
+// RegisterFunc makes fn callable from expressions by name, with between minArgs and maxArgs arguments.
+// A negative maxArgs allows any number of arguments. Calls are checked against the arity when expressions
+// are compiled, so functions should be registered before the rules that use them are loaded.
+// RegisterFunc panics if the name is already used by an operator or another function.
+func RegisterFunc(name string, minArgs, maxArgs int, fn Func) {
+	registerFunc(name, minArgs, maxArgs, fn, nil)
+}
+
+func registerFunc(name string, minArgs, maxArgs int, fn Func, check func(c *compiler, path string, args []Node)) {
+	funcsMu.Lock()
+	defer funcsMu.Unlock()
+	if _, ok := operators[name]; ok {
+		panic(fmt.Sprintf("ast: RegisterFunc: %s is an operator", name))
+	}
+	if _, ok := funcs[name]; ok {
+		panic(fmt.Sprintf("ast: RegisterFunc: %s is already registered", name))
+	}
+	funcs[name] = &function{fn: fn, minArgs: minArgs, maxArgs: maxArgs, check: check}
+}
+
+func lookupFunc(name string) (*function, bool) {
+	funcsMu.RLock()
+	defer funcsMu.RUnlock()
+	f, ok := funcs[name]
+	return f, ok
+}
+
+func funcLen(_ context.Context, args ...interface{}) (interface{}, error) {
+	if args[0] == nil {
+		return nil, nil
+	}
+	switch v := args[0].(type) {
+	case string:
+		return utf8.RuneCountInString(v), nil
+	case []interface{}:
+		return len(v), nil
+	case map[string]interface{}:
+		return len(v), nil
+	case map[string]string:
+		return len(v), nil
+	}
+	return nil, fmt.Errorf("len: unsupported type %T", args[0])
+}
+
+func funcLower(_ context.Context, args ...interface{}) (interface{}, error) {
+	if args[0] == nil {
+		return nil, nil
+	}
+	s, ok := args[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("lower: expected a string, got %T", args[0])
+	}
+	return strings.ToLower(s), nil
+}
+
+func funcUpper(_ context.Context, args ...interface{}) (interface{}, error) {
+	if args[0] == nil {
+		return nil, nil
+	}
+	s, ok := args[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("upper: expected a string, got %T", args[0])
+	}
+	return strings.ToUpper(s), nil
+}
+
+func funcAbs(_ context.Context, args ...interface{}) (interface{}, error) {
+	if args[0] == nil {
+		return nil, nil
+	}
+	switch v := args[0].(type) {
+	case int:
+		if v < 0 {
+			return -v, nil
+		}
+		return v, nil
+	default:
+		f, ok := toFloat(v)
+		if !ok {
+			return nil, fmt.Errorf("abs: expected a number, got %T", args[0])
+		}
+		return math.Abs(f), nil
+	}
+}
+
+// funcRound rounds a number half away from zero, to the given number of decimal places if any.
+func funcRound(_ context.Context, args ...interface{}) (interface{}, error) {
+	if args[0] == nil {
+		return nil, nil
+	}
+	f, ok := toFloat(args[0])
+	if !ok {
+		return nil, fmt.Errorf("round: expected a number, got %T", args[0])
+	}
+	if len(args) == 1 {
+		return math.Round(f), nil
+	}
+	places, ok := args[1].(int)
+	if !ok {
+		return nil, fmt.Errorf("round: expected an integer number of places, got %v", args[1])
+	}
+	scale := math.Pow(10, float64(places))
+	return math.Round(f*scale) / scale, nil
+}
+
+// funcCoalesce returns its first argument that is not nil.
+func funcCoalesce(_ context.Context, args ...interface{}) (interface{}, error) {
+	for _, arg := range args {
+		if arg != nil {
+			return arg, nil
+		}
+	}
+	return nil, nil
+}
+
+// funcNow returns the current time of the evaluation's Clock in Unix milliseconds, the unit of payload timestamps.
+func funcNow(ctx context.Context, _ ...interface{}) (interface{}, error) {
+	return Now(ctx).UnixMilli(), nil
+}
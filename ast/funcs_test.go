@@ -0,0 +1,80 @@
+package ast
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func init() {
+	RegisterFunc("test_domain", 1, 1, func(_ context.Context, args ...interface{}) (interface{}, error) {
+		s, ok := args[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("expected a string")
+		}
+		return s[strings.IndexByte(s, '@')+1:], nil
+	})
+	RegisterFunc("test_is_internal", 1, 1, func(_ context.Context, args ...interface{}) (interface{}, error) {
+		return args[0] == "example.com", nil
+	})
+}
+
+func TestEvaluateArithmeticAndFuncs(t *testing.T) {
+	event := map[string]interface{}{
+		"qty":     3,
+		"price":   400.5,
+		"country": "DE",
+		"email":   "ops@example.com",
+		"delta":   -7,
+		"tags":    []interface{}{"a", "b"},
+		"empty":   nil,
+	}
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{`(> (* qty price) 1000)`, true},
+		{`(== (+ qty 1 2) 6)`, true},
+		{`(== (- qty) -3)`, true},
+		{`(== (- 10 qty 2) 5)`, true},
+		{`(== (/ qty 2) 1.5)`, true},
+		{`(== (% 10 qty) 1)`, true},
+		{`(== (lower country) "de")`, true},
+		{`(== (upper (lower country)) "DE")`, true},
+		{`(== (abs delta) 7)`, true},
+		{`(== (round 2.345 2) 2.35)`, true},
+		{`(== (round price) 401)`, true},
+		{`(== (len tags) 2)`, true},
+		{`(== (len "héllo") 5)`, true},
+		{`(== (coalesce empty "none") "none")`, true},
+		{`(> (now) 0)`, true},
+		{`(== (test_domain email) "example.com")`, true},
+		{`(test_is_internal (test_domain email))`, true},
+	}
+	for _, tt := range tests {
+		p, err := CompileString(tt.expr)
+		if err != nil {
+			t.Errorf("%s: compile: %v", tt.expr, err)
+			continue
+		}
+		got, err := p.Evaluate(event)
+		if err != nil {
+			t.Errorf("%s: evaluate: %v", tt.expr, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: expected %v, got %v", tt.expr, tt.want, got)
+		}
+	}
+
+	if _, err := Evaluate([]interface{}{Symbol("=="), []interface{}{Symbol("/"), Symbol("qty"), 0}, 1}, event); !errors.Is(err, errDivisionByZero) {
+		t.Errorf("expected division by zero, got %v", err)
+	}
+	for _, expr := range []string{`(== (lower) "de")`, `(== (round 1 2 3) 1)`, `(== (nope x) 1)`, `(+ qty 1)`, `(== (+ qty) 1)`} {
+		if _, err := CompileString(expr); err == nil {
+			t.Errorf("%s: expected a compile error", expr)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package ast
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Index finds the programs matching an event among many, without evaluating every one of them.
+// Programs whose first condition compares a field to literals with == or in, e.g. (== status "active")
+// or (and (in country ("DE" "FR")) (> amount 100)), are looked up by the value of the field in the event,
+// and only those that can match are evaluated. As the first condition is evaluated first, the programs
+// skipped are exactly those that evaluate to false without an error, so Match gives the same result
+// as evaluating every program. Other programs, and programs with a schema, are evaluated for every event.
+//
+// An Index is safe for concurrent use by Match and Candidates once all its programs have been added.
+type Index struct {
+	programs []*Program
+	fields   map[indexField]*postings
+	always   []int // ids of the programs that are not indexed
+}
+
+// indexField is a field programs are indexed on. Programs with different coercion policies
+// compare values differently, so they are indexed apart.
+type indexField struct {
+	name     string
+	coercion Coercion
+}
+
+// postings are the ids of the programs indexed on a field, by the literal their first condition compares it to.
+// Literals are kept apart by type, along with all the programs comparing the field to literals of a type,
+// which are candidates when the value of the field cannot be compared to them by hashing.
+type postings struct {
+	numbers    map[float64][]int
+	strings    map[string][]int
+	bools      [2][]int // false, true
+	nulls      []int
+	allNumbers []int
+	allStrings []int
+	allBools   []int
+}
+
+// NewIndex returns an empty index.
+func NewIndex() *Index {
+	return &Index{fields: make(map[indexField]*postings)}
+}
+
+// Len returns the number of programs in the index.
+func (ix *Index) Len() int {
+	return len(ix.programs)
+}
+
+// Add adds a program to the index and returns its id, the number of programs added before it.
+func (ix *Index) Add(p *Program) int {
+	id := len(ix.programs)
+	ix.programs = append(ix.programs, p)
+	name, literals, ok := indexedCondition(p.Root)
+	if !ok || p.cfg.schema != nil {
+		ix.always = append(ix.always, id)
+		return id
+	}
+	field := indexField{name: name, coercion: p.cfg.coercion}
+	post, ok := ix.fields[field]
+	if !ok {
+		post = &postings{numbers: make(map[float64][]int), strings: make(map[string][]int)}
+		ix.fields[field] = post
+	}
+	for _, literal := range literals {
+		v := fromInterface(literal)
+		switch v.kind {
+		case vInt, vFloat:
+			f, _ := v.number()
+			post.numbers[f] = appendID(post.numbers[f], id)
+			post.allNumbers = appendID(post.allNumbers, id)
+		case vString:
+			post.strings[v.s] = appendID(post.strings[v.s], id)
+			post.allStrings = appendID(post.allStrings, id)
+		case vBool:
+			post.bools[boolIndex(v.b)] = appendID(post.bools[boolIndex(v.b)], id)
+			post.allBools = appendID(post.allBools, id)
+		case vNull:
+			post.nulls = appendID(post.nulls, id)
+		}
+	}
+	return id
+}
+
+// appendID appends id unless it was just appended, as a program may list the same literal twice.
+func appendID(ids []int, id int) []int {
+	if len(ids) > 0 && ids[len(ids)-1] == id {
+		return ids
+	}
+	return append(ids, id)
+}
+
+func boolIndex(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// indexedCondition returns the field and the literals compared by the first condition of a program,
+// if it is an == or an in between a field and literals.
+func indexedCondition(n Node) (string, []interface{}, bool) {
+	for {
+		call, ok := n.(*Call)
+		if !ok || call.Op != "and" {
+			break
+		}
+		n = call.Args[0]
+	}
+	call, ok := n.(*Call)
+	if !ok {
+		return "", nil, false
+	}
+	switch call.Op {
+	case "==":
+		ident, ok := call.Args[0].(*Ident)
+		lit, isLit := call.Args[1].(*Literal)
+		if !ok || !isLit {
+			ident, ok = call.Args[1].(*Ident)
+			lit, isLit = call.Args[0].(*Literal)
+		}
+		if ok && isLit {
+			return ident.Name, []interface{}{lit.Value}, true
+		}
+	case "in":
+		ident, ok := call.Args[0].(*Ident)
+		list, isList := call.Args[1].(*List)
+		if ok && isList {
+			literals := make([]interface{}, len(list.Items))
+			for i, item := range list.Items {
+				literals[i] = item.(*Literal).Value
+			}
+			return ident.Name, literals, true
+		}
+	}
+	return "", nil, false
+}
+
+// Candidates returns the ids of the programs that may match the event, in ascending order.
+// The programs that are not candidates evaluate to false without an error.
+func (ix *Index) Candidates(event map[string]interface{}) []int {
+	ids := slices.Clone(ix.always)
+	for field, post := range ix.fields {
+		found, _, _ := lookup(event, field.name, nil)
+		ids = post.candidates(ids, fromInterface(found), field.coercion)
+	}
+	slices.Sort(ids)
+	return slices.Compact(ids)
+}
+
+// candidates appends the ids of the programs whose first condition can be true or fail for value v of the field.
+// Two values are compared by hashing only when equal says they are equal if and only if they hash the same,
+// and never fails: otherwise all the programs comparing the field to literals of the type are candidates.
+func (post *postings) candidates(ids []int, v value, coercion Coercion) []int {
+	if v.kind == vNull {
+		// null is only equal to null, and comparing to it never fails
+		return append(ids, post.nulls...)
+	}
+	switch n, ok := numberKey(v, coercion); {
+	case ok:
+		ids = append(ids, post.numbers[n]...)
+	case len(post.numbers) > 0:
+		ids = append(ids, post.allNumbers...)
+	}
+	if v.kind == vString {
+		ids = append(ids, post.strings[v.s]...)
+	} else {
+		// lenient coercion may make a number or a bool equal to a string, or else comparing them fails
+		ids = append(ids, post.allStrings...)
+	}
+	switch b, ok := boolKey(v, coercion); {
+	case ok:
+		ids = append(ids, post.bools[boolIndex(b)]...)
+	default:
+		ids = append(ids, post.allBools...)
+	}
+	return ids
+}
+
+func numberKey(v value, coercion Coercion) (float64, bool) {
+	if v.kind == vString && coercion == CoercionLenient {
+		i, f, isInt, ok := parseNumeric(strings.TrimSpace(v.s))
+		if isInt {
+			return float64(i), ok
+		}
+		return f, ok
+	}
+	return v.number()
+}
+
+func boolKey(v value, coercion Coercion) (bool, bool) {
+	if v.kind == vString && coercion == CoercionLenient {
+		return parseBool(strings.TrimSpace(v.s))
+	}
+	return v.b, v.kind == vBool
+}
+
+// Match returns the ids of the programs matching the event, in ascending order.
+// The programs whose evaluation fails do not match, and their errors are joined in the returned error.
+func (ix *Index) Match(event map[string]interface{}) ([]int, error) {
+	var (
+		matches []int
+		errs    []error
+	)
+	for _, id := range ix.Candidates(event) {
+		ok, err := ix.programs[id].Evaluate(event)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("program %d: %w", id, err))
+			continue
+		}
+		if ok {
+			matches = append(matches, id)
+		}
+	}
+	return matches, errors.Join(errs...)
+}
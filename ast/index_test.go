@@ -0,0 +1,142 @@
+package ast
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+// TestIndexMatchesEveryProgram checks that an index matches the same programs, with the same errors,
+// as evaluating every program.
+func TestIndexMatchesEveryProgram(t *testing.T) {
+	exprs := []string{
+		`(== status "active")`,
+		`(== "active" status)`,
+		`(and (== status "pending") (> amount 100))`,
+		`(and (and (in country ("DE" "FR" "DE")) (exists amount)) (< amount 50))`,
+		`(in amount (10 20.5 "30"))`,
+		`(== amount 10)`,
+		`(== vip true)`,
+		`(in vip (false null))`,
+		`(== coupon null)`,
+		`(== user.tier "gold")`,
+		`(> amount 10)`,
+		`(or (== status "active") (== status "pending"))`,
+		`(and (> amount 10) (== status "active"))`,
+	}
+	var programs []*Program
+	ix := NewIndex()
+	for _, coercion := range []Coercion{CoercionLenient, CoercionStrict} {
+		for _, s := range exprs {
+			p, err := CompileString(s, WithCoercion(coercion))
+			if err != nil {
+				t.Fatalf("%s: %v", s, err)
+			}
+			programs = append(programs, p)
+			ix.Add(p)
+		}
+	}
+	p, err := CompileString(`(== amount 10)`, WithSchema(Schema{"amount": {Type: TypeNumber}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	programs = append(programs, p)
+	ix.Add(p)
+
+	values := []interface{}{nil, "active", "pending", " 10 ", "10", 10, 10.0, int64(20), 20.5, "30", 30, "abc",
+		true, false, "true", "no", "DE", []interface{}{"DE"}}
+	var events []map[string]interface{}
+	for _, field := range []string{"status", "amount", "vip", "country", "coupon", "user.tier"} {
+		for _, v := range values {
+			events = append(events, map[string]interface{}{field: v})
+		}
+	}
+	events = append(events,
+		map[string]interface{}{},
+		map[string]interface{}{"status": "pending", "amount": 101, "country": "FR", "user": map[string]interface{}{"tier": "gold"}},
+		map[string]interface{}{"country": "DE", "amount": "7", "vip": "false", "coupon": nil},
+	)
+
+	for i, event := range events {
+		var want []int
+		var wantErrs []string
+		for id, p := range programs {
+			ok, err := p.Evaluate(event)
+			if err != nil {
+				wantErrs = append(wantErrs, fmt.Sprintf("program %d: %v", id, err))
+			} else if ok {
+				want = append(want, id)
+			}
+		}
+		got, err := ix.Match(event)
+		if !slices.Equal(got, want) {
+			t.Errorf("event %d %v: got %v, want %v", i, event, got, want)
+		}
+		var gotErrs []string
+		if err != nil {
+			for _, e := range err.(interface{ Unwrap() []error }).Unwrap() {
+				gotErrs = append(gotErrs, e.Error())
+			}
+		}
+		if !slices.Equal(gotErrs, wantErrs) {
+			t.Errorf("event %d %v: got errors %q, want %q", i, event, gotErrs, wantErrs)
+		}
+	}
+}
+
+func TestIndexCandidates(t *testing.T) {
+	ix := NewIndex()
+	for i := 0; i < 100; i++ {
+		p, err := CompileString(fmt.Sprintf(`(and (== campaign "c%d") (> amount %d))`, i, i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ix.Add(p)
+	}
+	p, err := CompileString(`(> amount 1000)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ix.Add(p)
+
+	got := ix.Candidates(map[string]interface{}{"campaign": "c42", "amount": 50})
+	if want := []int{42, 100}; !slices.Equal(got, want) {
+		t.Errorf("got candidates %v, want %v", got, want)
+	}
+	got = ix.Candidates(map[string]interface{}{"campaign": 42, "amount": 50})
+	if len(got) != ix.Len() {
+		t.Errorf("got %d candidates for a number compared to strings, want all %d", len(got), ix.Len())
+	}
+}
+
+func BenchmarkIndexMatch(b *testing.B) {
+	ix := NewIndex()
+	var programs []*Program
+	for i := 0; i < 500; i++ {
+		p, err := CompileString(fmt.Sprintf(`(and (== campaign "c%d") (> amount %d))`, i%100, i))
+		if err != nil {
+			b.Fatal(err)
+		}
+		programs = append(programs, p)
+		ix.Add(p)
+	}
+	event := map[string]interface{}{"campaign": "c42", "amount": 250}
+	b.Run("index", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := ix.Match(event); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("every program", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, p := range programs {
+				if _, err := p.Evaluate(event); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,502 @@
+package ast
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ParseInfix parses an expression written in infix syntax, such as
+//
+//	age == 20 && status in ["active", "pending"]
+//
+// into the same tree as its S expression, here (and (== age 20) (in status ("active" "pending"))).
+//
+// From lowest to highest precedence, the infix syntax has:
+//   - || and or
+//   - && and and
+//   - ! and not, which apply to a whole comparison: !a == b is (not (== a b))
+//   - comparisons: == != <> < <= > >= in, not in, not_in, contains, starts_with, ends_with, ieq, matches
+//   - + and -
+//   - * / and %
+//   - unary -
+//
+// Every other operator and function is written as a call, e.g. between(latency, 100, 500),
+// exists(user.id), any(items[*].price > 100) or lower(country). Lists are written in brackets,
+// and identifiers that are not plain paths, such as a field named order-id, in backquotes: `order-id`.
+//
+// The expression must be within the Limits given WithLimits or else the DefaultLimits,
+// where every parenthesized group also counts towards the maximum depth.
+func ParseInfix(s string, opts ...Option) (Expression, error) {
+	expr, _, err := parseInfix(s, newConfig(opts).limits)
+	return expr, err
+}
+
+// CompileInfix parses an expression in infix syntax and compiles it.
+// Errors carry the position of the offending node in s.
+func CompileInfix(s string, opts ...Option) (*Program, error) {
+	expr, positions, err := parseInfix(s, newConfig(opts).limits)
+	if err != nil {
+		return nil, err
+	}
+	p, err := Compile(expr, opts...)
+	setPositions(err, positions)
+	return p, err
+}
+
+const (
+	precOr = iota + 1
+	precAnd
+	precNot
+	precCompare
+	precAdd
+	precMul
+	precUnary
+	precPrimary
+)
+
+// infixOperators maps the binary operators of the infix syntax to their operator and precedence.
+var infixOperators = map[string]struct {
+	op   string
+	prec int
+}{
+	"||": {"or", precOr}, "or": {"or", precOr},
+	"&&": {"and", precAnd}, "and": {"and", precAnd},
+	"==": {"==", precCompare}, "!=": {"!=", precCompare}, "<>": {"<>", precCompare},
+	"<": {"<", precCompare}, "<=": {"<=", precCompare}, ">": {">", precCompare}, ">=": {">=", precCompare},
+	"in": {"in", precCompare}, "not_in": {"not_in", precCompare}, "contains": {"contains", precCompare},
+	"starts_with": {"starts_with", precCompare}, "ends_with": {"ends_with", precCompare},
+	"ieq": {"ieq", precCompare}, "matches": {"matches", precCompare},
+	"+": {"+", precAdd}, "-": {"-", precAdd},
+	"*": {"*", precMul}, "/": {"/", precMul}, "%": {"%", precMul},
+}
+
+// pnode is a node being parsed, with its position and the positions of its children,
+// from which the positions of every path of the final expression are recorded.
+type pnode struct {
+	expr Expression
+	pos  Pos
+	kids []*pnode
+}
+
+func (n *pnode) record(path string, positions map[string]Pos) {
+	positions[path] = n.pos
+	for i, kid := range n.kids {
+		if kid != nil {
+			kid.record(fmt.Sprintf("%s[%d]", path, i), positions)
+		}
+	}
+}
+
+func newCall(op string, pos Pos, operands ...*pnode) *pnode {
+	call := []interface{}{Symbol(op)}
+	kids := []*pnode{{expr: Symbol(op), pos: pos}}
+	for _, operand := range operands {
+		call = append(call, operand.expr)
+		kids = append(kids, operand)
+	}
+	return &pnode{expr: call, pos: pos, kids: kids}
+}
+
+type infixParser struct {
+	lex    *lexer
+	tok    token
+	limits Limits
+	depth  int // the nesting of the groups, calls, lists and unary operators being parsed
+}
+
+func parseInfix(s string, limits Limits) (Expression, map[string]Pos, error) {
+	p := &infixParser{lex: newLexer(s), limits: limits}
+	if err := p.next(); err != nil {
+		return nil, nil, err
+	}
+	if p.tok.kind == tokenEOF {
+		return nil, nil, &SyntaxError{Pos: p.tok.pos, Msg: "empty expression"}
+	}
+	n, err := p.parseBinary(precOr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if p.tok.kind != tokenEOF {
+		return nil, nil, &SyntaxError{Pos: p.tok.pos, Token: p.tok.text, Msg: "unexpected token after expression"}
+	}
+	positions := make(map[string]Pos)
+	n.record("$", positions)
+	if err := checkLimits(n.expr, limits); err != nil {
+		setPositions(err, positions)
+		return nil, nil, err
+	}
+	return n.expr, positions, nil
+}
+
+// enter guards the recursion of the parser against deeply nested input, before the limits of the expression can be checked.
+func (p *infixParser) enter(tok token) error {
+	p.depth++
+	if p.limits.MaxDepth > 0 && p.depth > p.limits.MaxDepth {
+		return &LimitError{Limit: "depth", Max: p.limits.MaxDepth, Pos: tok.pos}
+	}
+	return nil
+}
+
+func (p *infixParser) leave() {
+	p.depth--
+}
+
+func (p *infixParser) next() error {
+	tok, err := p.lex.nextInfix()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
+
+// binaryOperator returns the binary operator at the current token, if any.
+// "not in" is read as not_in.
+func (p *infixParser) binaryOperator() (string, int, bool) {
+	if p.tok.kind != tokenOperator && p.tok.kind != tokenSymbol {
+		return "", 0, false
+	}
+	if p.tok.kind == tokenSymbol && p.tok.text == "not" {
+		l := *p.lex
+		tok, err := l.nextInfix()
+		if err == nil && tok.kind == tokenSymbol && tok.text == "in" {
+			return "not_in", precCompare, true
+		}
+		return "", 0, false
+	}
+	info, ok := infixOperators[p.tok.text]
+	if !ok {
+		return "", 0, false
+	}
+	return info.op, info.prec, true
+}
+
+// parseBinary parses a chain of binary operators of at least the given precedence.
+// Chains of the same associative operator are flattened, so a && b && c is (and a b c), and a - b - c is (- a b c).
+func (p *infixParser) parseBinary(prec int) (*pnode, error) {
+	if prec == precNot {
+		return p.parseNot()
+	}
+	if prec == precUnary {
+		return p.parseUnary()
+	}
+	left, err := p.parseBinary(prec + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, opPrec, ok := p.binaryOperator()
+		if !ok || opPrec != prec {
+			return left, nil
+		}
+		opTok := p.tok
+		if op == "not_in" && opTok.text == "not" {
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		operands := []*pnode{left}
+		for {
+			right, err := p.parseBinary(prec + 1)
+			if err != nil {
+				return nil, err
+			}
+			operands = append(operands, right)
+			if prec == precCompare {
+				break
+			}
+			nextOp, _, ok := p.binaryOperator()
+			if !ok || nextOp != op {
+				break
+			}
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+		}
+		left = newCall(op, opTok.pos, operands...)
+		if prec == precCompare {
+			if _, nextPrec, ok := p.binaryOperator(); ok && nextPrec == precCompare {
+				return nil, &SyntaxError{Pos: p.tok.pos, Token: p.tok.text, Msg: "comparisons cannot be chained"}
+			}
+		}
+	}
+}
+
+func (p *infixParser) parseNot() (*pnode, error) {
+	if (p.tok.kind == tokenOperator && p.tok.text == "!") || (p.tok.kind == tokenSymbol && p.tok.text == "not") {
+		tok := p.tok
+		if err := p.enter(tok); err != nil {
+			return nil, err
+		}
+		defer p.leave()
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return newCall("not", tok.pos, operand), nil
+	}
+	return p.parseBinary(precCompare)
+}
+
+func (p *infixParser) parseUnary() (*pnode, error) {
+	if p.tok.kind == tokenOperator && p.tok.text == "-" {
+		tok := p.tok
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		// a minus directly followed by a number is a negative literal, as in an S expression
+		if num := p.tok; num.kind == tokenNumber {
+			switch v := num.value.(type) {
+			case int:
+				return &pnode{expr: -v, pos: tok.pos}, p.next()
+			case float64:
+				return &pnode{expr: -v, pos: tok.pos}, p.next()
+			}
+		}
+		if err := p.enter(tok); err != nil {
+			return nil, err
+		}
+		defer p.leave()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return newCall("-", tok.pos, operand), nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *infixParser) parsePrimary() (*pnode, error) {
+	tok := p.tok
+	switch tok.kind {
+	case tokenString, tokenNumber:
+		return &pnode{expr: tok.value, pos: tok.pos}, p.next()
+	case tokenLParen:
+		if err := p.enter(tok); err != nil {
+			return nil, err
+		}
+		defer p.leave()
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		n, err := p.parseBinary(precOr)
+		if err != nil {
+			return nil, err
+		}
+		if p.tok.kind != tokenRParen {
+			return nil, p.unexpected("missing closing parenthesis")
+		}
+		return n, p.next()
+	case tokenLBracket:
+		return p.parseList()
+	case tokenSymbol, tokenQuotedSymbol:
+		if tok.kind == tokenSymbol {
+			switch tok.text {
+			case "true":
+				return &pnode{expr: true, pos: tok.pos}, p.next()
+			case "false":
+				return &pnode{expr: false, pos: tok.pos}, p.next()
+			case "null":
+				return &pnode{expr: nil, pos: tok.pos}, p.next()
+			}
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if tok.kind == tokenSymbol && p.tok.kind == tokenLParen {
+			return p.parseCall(tok)
+		}
+		if _, ok := infixOperators[tok.text]; (ok || tok.text == "not") && tok.kind == tokenSymbol {
+			return nil, &SyntaxError{Pos: tok.pos, Token: tok.text, Msg: "unexpected operator"}
+		}
+		return &pnode{expr: Symbol(tok.value.(string)), pos: tok.pos}, nil
+	case tokenEOF:
+		return nil, &SyntaxError{Pos: tok.pos, Msg: "unexpected end of input"}
+	}
+	return nil, p.unexpected("unexpected token")
+}
+
+func (p *infixParser) parseCall(name token) (*pnode, error) {
+	if err := p.enter(name); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+	if err := p.next(); err != nil { // remove "("
+		return nil, err
+	}
+	var args []*pnode
+	for p.tok.kind != tokenRParen {
+		if len(args) > 0 {
+			if p.tok.kind != tokenComma {
+				return nil, p.unexpected("expected , or )")
+			}
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+		}
+		arg, err := p.parseBinary(precOr)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	return newCall(name.text, name.pos, args...), p.next()
+}
+
+func (p *infixParser) parseList() (*pnode, error) {
+	start := p.tok
+	if err := p.enter(start); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+	if err := p.next(); err != nil { // remove "["
+		return nil, err
+	}
+	list := &pnode{expr: []interface{}{}, pos: start.pos}
+	for p.tok.kind != tokenRBracket {
+		if p.tok.kind == tokenEOF {
+			return nil, &SyntaxError{Pos: start.pos, Token: start.text, Msg: "missing closing bracket"}
+		}
+		if len(list.kids) > 0 {
+			if p.tok.kind != tokenComma {
+				return nil, p.unexpected("expected , or ]")
+			}
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+		}
+		item, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		list.expr = append(list.expr.([]interface{}), item.expr)
+		list.kids = append(list.kids, item)
+	}
+	return list, p.next()
+}
+
+func (p *infixParser) unexpected(msg string) error {
+	if p.tok.kind == tokenEOF {
+		return &SyntaxError{Pos: p.tok.pos, Msg: "unexpected end of input"}
+	}
+	return &SyntaxError{Pos: p.tok.pos, Token: p.tok.text, Msg: msg}
+}
+
+// nextInfix returns the next token of an expression in infix syntax.
+func (l *lexer) nextInfix() (token, error) {
+	for !l.eof() && isSpace(l.peek()) {
+		l.advance()
+	}
+	start, begin := l.pos, l.offset
+	if l.eof() {
+		return token{kind: tokenEOF, pos: start}, nil
+	}
+	r := l.peek()
+	switch {
+	case r == '"':
+		return l.lexString()
+	case r == '`':
+		l.advance()
+		for !l.eof() && l.peek() != '`' {
+			l.advance()
+		}
+		if l.eof() {
+			return token{}, &SyntaxError{Pos: start, Token: l.src[begin:l.offset], Msg: "unterminated quoted identifier"}
+		}
+		l.advance()
+		text := l.src[begin:l.offset]
+		return token{kind: tokenQuotedSymbol, text: text, value: text[1 : len(text)-1], pos: start}, nil
+	case r >= '0' && r <= '9' || r == '.':
+		for !l.eof() && (isIdentRune(l.peek()) || l.peek() == '.' ||
+			((l.peek() == '-' || l.peek() == '+') && strings.HasSuffix(strings.ToLower(l.src[begin:l.offset]), "e"))) {
+			l.advance()
+		}
+		text := l.src[begin:l.offset]
+		if n, ok := parseNumber(text); ok {
+			return token{kind: tokenNumber, text: text, value: n, pos: start}, nil
+		}
+		return token{}, &SyntaxError{Pos: start, Token: text, Msg: "invalid number"}
+	case isIdentRune(r):
+		l.lexPath()
+		text := l.src[begin:l.offset]
+		return token{kind: tokenSymbol, text: text, value: text, pos: start}, nil
+	}
+
+	l.advance()
+	switch r {
+	case '(':
+		return token{kind: tokenLParen, text: "(", pos: start}, nil
+	case ')':
+		return token{kind: tokenRParen, text: ")", pos: start}, nil
+	case '[':
+		return token{kind: tokenLBracket, text: "[", pos: start}, nil
+	case ']':
+		return token{kind: tokenRBracket, text: "]", pos: start}, nil
+	case ',':
+		return token{kind: tokenComma, text: ",", pos: start}, nil
+	case '=', '!', '<', '>', '&', '|':
+		if !l.eof() {
+			two := l.src[begin : l.offset+1]
+			switch two {
+			case "==", "!=", "<>", "<=", ">=", "&&", "||":
+				l.advance()
+				return token{kind: tokenOperator, text: two, pos: start}, nil
+			}
+		}
+		if r == '!' || r == '<' || r == '>' {
+			return token{kind: tokenOperator, text: string(r), pos: start}, nil
+		}
+	case '+', '-', '*', '/', '%':
+		return token{kind: tokenOperator, text: string(r), pos: start}, nil
+	}
+	return token{}, &SyntaxError{Pos: start, Token: l.src[begin:l.offset], Msg: "unexpected character"}
+}
+
+// lexPath reads an identifier with its path continuations: .key, [index] and [*].
+// A bracket only continues a path when it directly follows it, so that in [...] is still a list.
+func (l *lexer) lexPath() {
+	for !l.eof() {
+		switch r := l.peek(); {
+		case isIdentRune(r):
+			l.advance()
+		case r == '.':
+			l.advance()
+		case r == '[':
+			end := strings.IndexByte(l.src[l.offset:], ']')
+			if end < 0 || !isIndex(l.src[l.offset+1:l.offset+end]) {
+				return
+			}
+			for i := 0; i <= end; i++ {
+				l.advance()
+			}
+		default:
+			return
+		}
+	}
+}
+
+func isIndex(s string) bool {
+	if s == "*" {
+		return true
+	}
+	s = strings.TrimPrefix(s, "-")
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func isIdentRune(r rune) bool {
+	return r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9'
+}
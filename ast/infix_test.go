@@ -0,0 +1,121 @@
+package ast
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseInfix(t *testing.T) {
+	tests := []struct {
+		infix string
+		sexpr string
+	}{
+		{`age == 20 && status in ["active", "pending"]`, `(and (== age 20) (in status ("active" "pending")))`},
+		{`a && b && c || d`, `(or (and a b c) d)`},
+		{`(a || b) && c`, `(and (or a b) c)`},
+		{`a and not b or c`, `(or (and a (not b)) c)`},
+		{`!a == b`, `(not (== a b))`},
+		{`x not in [1, -2.5] && y not_in ["a"]`, `(and (not_in x (1 -2.5)) (not_in y ("a")))`},
+		{`qty * price > 1000`, `(> (* qty price) 1000)`},
+		{`a + b * c - d - e == 0`, `(== (- (+ a (* b c)) d e) 0)`},
+		{`-x < -1`, `(< (- x) -1)`},
+		{`lower(country) == "de"`, `(== (lower country) "de")`},
+		{`between(latency, 100, 500) && exists(user.address.city)`, `(and (between latency 100 500) (exists user.address.city))`},
+		{`any(items[*].price > 100)`, `(any (> items[*].price 100))`},
+		{`path starts_with "/api" && email matches ".*@example\\.com"`, `(and (starts_with path "/api") (matches email ".*@example\\.com"))`},
+		{"`order-id` == null && flag == true", `(and (== order-id null) (== flag true))`},
+		{`coalesce(a, "x") != "y"`, `(!= (coalesce a "x") "y")`},
+	}
+	for _, tt := range tests {
+		got, err := ParseInfix(tt.infix)
+		if err != nil {
+			t.Errorf("%s: %v", tt.infix, err)
+			continue
+		}
+		want, err := ParseExpression(tt.sexpr)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.sexpr, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: expected %#v, got %#v", tt.infix, want, got)
+		}
+	}
+}
+
+func TestParseInfixErrors(t *testing.T) {
+	tests := []struct {
+		src string
+		pos Pos
+	}{
+		{`a == b == c`, Pos{1, 8}},
+		{`a == `, Pos{1, 6}},
+		{`(a == b`, Pos{1, 8}},
+		{`status in ["a", "b"`, Pos{1, 11}},
+		{`a # b`, Pos{1, 3}},
+		{`and == 1`, Pos{1, 1}},
+	}
+	for _, tt := range tests {
+		_, err := ParseInfix(tt.src)
+		var syntaxErr *SyntaxError
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("%q: expected a SyntaxError, got %v", tt.src, err)
+			continue
+		}
+		if syntaxErr.Pos != tt.pos {
+			t.Errorf("%q: expected an error at %s, got %v", tt.src, tt.pos, err)
+		}
+	}
+
+	_, err := CompileInfix("a == 1 &&\n  foo(b)")
+	var errs CompileErrors
+	if !errors.As(err, &errs) || errs[0].Pos != (Pos{2, 3}) {
+		t.Errorf("expected a compile error at 2:3, got %v", err)
+	}
+}
+
+func TestFormatRoundTrip(t *testing.T) {
+	tests := []string{
+		`(and (== age 20) (>= score 51) (in status ("active" "pending")))`,
+		`(or (and a b) (and (or c d) e) (not (== f "x\n\"y\"")))`,
+		`(and (and a b) c)`,
+		`(== (- (+ a (* b c)) d e) (- (- 1)))`,
+		`(== (- (- a b) c) (/ (% x 3) 2.0))`,
+		`(< (- x) -1.5e-07)`,
+		`(not (not a))`,
+		`(any (all (!= orders[*].items[*].sku "A1")))`,
+		`(and (between latency 100 500) (exists user.id) (missing order-id))`,
+		`(and (not_in status ()) (contains tags "new") (ieq name "Bob") (== x null))`,
+		`(and (== (round price 2) 10.0) (test_is_internal (test_domain email)))`,
+		`(and a)`,
+	}
+	for _, src := range tests {
+		expr, err := ParseExpression(src)
+		if err != nil {
+			t.Fatalf("%s: %v", src, err)
+		}
+
+		sexpr, err := FormatSExpr(expr)
+		if err != nil {
+			t.Errorf("%s: format S expression: %v", src, err)
+			continue
+		}
+		if sexpr != src {
+			t.Errorf("expected %s, got %s", src, sexpr)
+		}
+
+		infix, err := FormatInfix(expr)
+		if err != nil {
+			t.Errorf("%s: format infix: %v", src, err)
+			continue
+		}
+		back, err := ParseInfix(infix)
+		if err != nil {
+			t.Errorf("%s: parse %s: %v", src, infix, err)
+			continue
+		}
+		if !reflect.DeepEqual(back, expr) {
+			t.Errorf("%s: infix %s parsed back to %#v", src, infix, back)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package ast
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// In JSON, an expression is written as documented on Expression: calls and lists are arrays,
+// numbers, true, false and null are themselves, and operators and identifiers are strings, e.g.
+//
+//	["and", ["==", "age", 20], ["in", "status", ["active", "pending"]], ["==", "country", "\"DE\""]]
+//
+// A string literal operand is written as a string holding its quoted S expression literal, such as "\"DE\"",
+// to tell it from an identifier. The items of the list operand of in and not_in are only literals,
+// so strings are written as is there.
+
+// FormatJSON formats an expression as JSON, which ParseJSON parses back to the same expression.
+func FormatJSON(expr Expression) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := formatJSON(&buf, expr, false); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func formatJSON(buf *bytes.Buffer, expr Expression, inList bool) error {
+	switch e := expr.(type) {
+	case []interface{}:
+		call := isCall(e)
+		switch {
+		case call && inList:
+			return fmt.Errorf("call %v cannot be written in JSON as a list", e)
+		case !call && !inList && len(e) > 0:
+			if _, ok := e[0].(string); ok {
+				return fmt.Errorf("list %v can only be written in JSON as the list of in or not_in", e)
+			}
+		}
+		buf.WriteByte('[')
+		for i, item := range e {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			var err error
+			switch {
+			case i == 0 && call:
+				err = writeJSONString(buf, string(e[0].(Symbol)))
+			case call:
+				err = formatJSON(buf, item, listOperand(string(e[0].(Symbol)), i-1))
+			default:
+				err = formatJSON(buf, item, true)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+		return nil
+	case Symbol:
+		if inList || e == "" || e[0] == '"' || e == "true" || e == "false" || e == "null" {
+			return fmt.Errorf("%q cannot be written as a symbol in JSON", string(e))
+		}
+		return writeJSONString(buf, string(e))
+	case string:
+		if inList {
+			return writeJSONString(buf, e)
+		}
+		return writeJSONString(buf, quote(e))
+	default:
+		s, err := formatLiteral(e)
+		if err != nil {
+			return err
+		}
+		buf.WriteString(s)
+		return nil
+	}
+}
+
+// writeJSONString writes s as a JSON string, leaving operators such as > and < readable.
+func writeJSONString(buf *bytes.Buffer, s string) error {
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(s); err != nil {
+		return err
+	}
+	buf.Truncate(buf.Len() - 1) // the newline written by Encode
+	return nil
+}
+
+// listOperand reports whether the i-th operand of op is a list.
+func listOperand(op string, i int) bool {
+	o, ok := operators[op]
+	if !ok || len(o.args) == 0 {
+		return false
+	}
+	if i >= len(o.args) {
+		return o.variadic && o.args[len(o.args)-1] == kindList
+	}
+	return o.args[i] == kindList
+}
+
+// ParseJSON parses an expression written in JSON.
+func ParseJSON(data []byte, opts ...Option) (Expression, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("unexpected data after the expression")
+	}
+	expr, err := fromJSON(v, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkLimits(expr, newConfig(opts).limits); err != nil {
+		return nil, err
+	}
+	return expr, nil
+}
+
+// CompileJSON parses an expression written in JSON and compiles it.
+func CompileJSON(data []byte, opts ...Option) (*Program, error) {
+	expr, err := ParseJSON(data, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return Compile(expr, opts...)
+}
+
+// MarshalJSON formats the expression of the program as JSON.
+func (p *Program) MarshalJSON() ([]byte, error) {
+	return FormatJSON(p.expr)
+}
+
+func fromJSON(v interface{}, inList bool) (Expression, error) {
+	switch t := v.(type) {
+	case []interface{}:
+		op, isCall := "", false
+		if len(t) > 0 && !inList {
+			op, isCall = t[0].(string)
+		}
+		e := make([]interface{}, len(t))
+		for i, item := range t {
+			var err error
+			switch {
+			case i == 0 && isCall:
+				e[0] = Symbol(op)
+			case isCall:
+				e[i], err = fromJSON(item, listOperand(op, i-1))
+			default:
+				e[i], err = fromJSON(item, true)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		return e, nil
+	case string:
+		if inList {
+			return t, nil
+		}
+		if strings.HasPrefix(t, `"`) {
+			s, _, err := parse(t, Limits{})
+			if err != nil {
+				return nil, fmt.Errorf("invalid string literal %s: %v", t, err)
+			}
+			if _, ok := s.(string); !ok {
+				return nil, fmt.Errorf("invalid string literal %s", t)
+			}
+			return s, nil
+		}
+		switch t {
+		case "true", "false", "null":
+			// as in S expressions, these are literals rather than identifiers
+			s, _, err := parse(t, Limits{})
+			return s, err
+		}
+		return Symbol(t), nil
+	case json.Number:
+		n, ok := parseNumber(string(t))
+		if !ok {
+			return nil, fmt.Errorf("invalid number %s", t)
+		}
+		return n, nil
+	case bool, nil:
+		return t, nil
+	}
+	return nil, fmt.Errorf("invalid expression: %v", v)
+}
@@ -0,0 +1,103 @@
+package ast
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestJSONRoundTrip(t *testing.T) {
+	tests := []struct {
+		src  string
+		json string
+	}{
+		{`(and (== age 20) (>= score 51) (in status ("active" "pending")))`,
+			`["and",["==","age",20],[">=","score",51],["in","status",["active","pending"]]]`},
+		{`(== country "DE")`, `["==","country","\"DE\""]`},
+		{`(in kind ("and" "\"quoted\"" 1 2.0 true null))`, `["in","kind",["and","\"quoted\"",1,2.0,true,null]]`},
+		{`(or vip (== coupon null) false)`, `["or","vip",["==","coupon",null],false]`},
+		{`(== (lower name) "o\"neil\n")`, `["==",["lower","name"],"\"o\\\"neil\\n\""]`},
+		{`(any (> items[*].price (* 1.5 -2)))`, `["any",[">","items[*].price",["*",1.5,-2]]]`},
+		{`(not_in x ())`, `["not_in","x",[]]`},
+		{`vip`, `"vip"`},
+		{`true`, `true`},
+	}
+	for _, tt := range tests {
+		expr, err := ParseExpression(tt.src)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.src, err)
+		}
+		data, err := FormatJSON(expr)
+		if err != nil {
+			t.Errorf("%s: format JSON: %v", tt.src, err)
+			continue
+		}
+		if string(data) != tt.json {
+			t.Errorf("%s: expected %s, got %s", tt.src, tt.json, data)
+		}
+		back, err := ParseJSON(data)
+		if err != nil {
+			t.Errorf("%s: parse %s: %v", tt.src, data, err)
+			continue
+		}
+		if !reflect.DeepEqual(back, expr) {
+			t.Errorf("%s: JSON %s parsed back to %#v", tt.src, data, back)
+		}
+		sexpr, err := FormatSExpr(back)
+		if err != nil || sexpr != tt.src {
+			t.Errorf("%s: JSON %s formatted back to %s, %v", tt.src, data, sexpr, err)
+		}
+	}
+}
+
+func TestProgramMarshalJSON(t *testing.T) {
+	p, err := CompileJSON([]byte(`["and", ["==", "status", "\"active\""], [">", "amount", 100]]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err := p.Evaluate(map[string]interface{}{"status": "active", "amount": "150"})
+	if !ok || err != nil {
+		t.Errorf("got %v, %v", ok, err)
+	}
+	data, err := json.Marshal(struct {
+		Rule *Program `json:"rule"`
+	}{p})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var back struct {
+		Rule json.RawMessage `json:"rule"`
+	}
+	if err := json.Unmarshal(data, &back); err != nil {
+		t.Fatal(err)
+	}
+	expr, err := ParseJSON(back.Rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(expr, p.Expression()) {
+		t.Errorf("%s parsed back to %#v", data, expr)
+	}
+}
+
+func TestJSONErrors(t *testing.T) {
+	for _, src := range []string{
+		`{"op": "and"}`,
+		`["==", "x", "\"unterminated"]`,
+		`["==", "x", 1e999]`,
+		`["==", "x", 1] ["==", "y", 2]`,
+	} {
+		if expr, err := ParseJSON([]byte(src)); err == nil {
+			t.Errorf("%s: expected an error, got %#v", src, expr)
+		}
+	}
+	for _, expr := range []Expression{
+		[]interface{}{Symbol("=="), Symbol("x"), []interface{}{"a", "b"}},
+		[]interface{}{Symbol("in"), Symbol("x"), []interface{}{Symbol("y")}},
+		[]interface{}{Symbol("=="), Symbol(`"x`), 1},
+	} {
+		if data, err := FormatJSON(expr); err == nil {
+			t.Errorf("%#v: expected an error, got %s", expr, data)
+		}
+	}
+}
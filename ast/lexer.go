@@ -0,0 +1,214 @@
+package ast
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Pos is a position in the source text of an expression. Lines and columns start at 1.
+type Pos struct {
+	Line int
+	Col  int
+}
+
+func (p Pos) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Col)
+}
+
+// IsValid reports whether the position is known.
+func (p Pos) IsValid() bool {
+	return p.Line > 0
+}
+
+// SyntaxError is an error found while lexing or parsing an expression.
+type SyntaxError struct {
+	Pos   Pos
+	Token string // the offending token, empty at the end of input
+	Msg   string
+}
+
+func (e *SyntaxError) Error() string {
+	if e.Token == "" {
+		return fmt.Sprintf("%s: %s", e.Pos, e.Msg)
+	}
+	return fmt.Sprintf("%s: %s near %q", e.Pos, e.Msg, e.Token)
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenLParen
+	tokenRParen
+	tokenString
+	tokenNumber
+	tokenSymbol
+
+	// tokens of the infix syntax
+	tokenOperator
+	tokenLBracket
+	tokenRBracket
+	tokenComma
+	tokenQuotedSymbol
+)
+
+type token struct {
+	kind  tokenKind
+	text  string      // the token as written in the source
+	value interface{} // the decoded value of strings and numbers
+	pos   Pos
+}
+
+// lexer splits the source of an S expression into tokens.
+// Comments start with ';' and run to the end of the line.
+type lexer struct {
+	src    string
+	offset int
+	pos    Pos
+}
+
+func newLexer(src string) *lexer {
+	return &lexer{src: src, pos: Pos{Line: 1, Col: 1}}
+}
+
+func (l *lexer) peek() rune {
+	if l.offset >= len(l.src) {
+		return utf8.RuneError
+	}
+	r, _ := utf8.DecodeRuneInString(l.src[l.offset:])
+	return r
+}
+
+func (l *lexer) eof() bool {
+	return l.offset >= len(l.src)
+}
+
+func (l *lexer) advance() rune {
+	r, size := utf8.DecodeRuneInString(l.src[l.offset:])
+	l.offset += size
+	if r == '\n' {
+		l.pos.Line++
+		l.pos.Col = 1
+	} else {
+		l.pos.Col++
+	}
+	return r
+}
+
+func (l *lexer) skipSpaceAndComments() {
+	for !l.eof() {
+		switch r := l.peek(); {
+		case r == ';':
+			for !l.eof() && l.peek() != '\n' {
+				l.advance()
+			}
+		case isSpace(r):
+			l.advance()
+		default:
+			return
+		}
+	}
+}
+
+func (l *lexer) next() (token, error) {
+	l.skipSpaceAndComments()
+	start := l.pos
+	if l.eof() {
+		return token{kind: tokenEOF, pos: start}, nil
+	}
+	switch r := l.peek(); r {
+	case '(':
+		l.advance()
+		return token{kind: tokenLParen, text: "(", pos: start}, nil
+	case ')':
+		l.advance()
+		return token{kind: tokenRParen, text: ")", pos: start}, nil
+	case '"':
+		return l.lexString()
+	default:
+		return l.lexAtom()
+	}
+}
+
+func (l *lexer) lexString() (token, error) {
+	start, begin := l.pos, l.offset
+	l.advance() // opening quote
+	var sb strings.Builder
+	for {
+		if l.eof() {
+			return token{}, &SyntaxError{Pos: start, Token: l.src[begin:l.offset], Msg: "unterminated string"}
+		}
+		escOffset, escPos := l.offset, l.pos
+		r := l.advance()
+		switch r {
+		case '"':
+			return token{kind: tokenString, text: l.src[begin:l.offset], value: sb.String(), pos: start}, nil
+		case '\\':
+			if l.eof() {
+				return token{}, &SyntaxError{Pos: start, Token: l.src[begin:l.offset], Msg: "unterminated string"}
+			}
+			switch e := l.advance(); e {
+			case '"', '\\', '/':
+				sb.WriteRune(e)
+			case 'n':
+				sb.WriteByte('\n')
+			case 't':
+				sb.WriteByte('\t')
+			case 'r':
+				sb.WriteByte('\r')
+			case 'u':
+				if len(l.src)-l.offset < 4 {
+					return token{}, &SyntaxError{Pos: escPos, Token: l.src[escOffset:], Msg: "invalid unicode escape"}
+				}
+				code, err := strconv.ParseUint(l.src[l.offset:l.offset+4], 16, 32)
+				if err != nil {
+					return token{}, &SyntaxError{Pos: escPos, Token: l.src[escOffset : l.offset+4], Msg: "invalid unicode escape"}
+				}
+				for i := 0; i < 4; i++ {
+					l.advance()
+				}
+				sb.WriteRune(rune(code))
+			default:
+				return token{}, &SyntaxError{Pos: escPos, Token: `\` + string(e), Msg: "invalid escape sequence"}
+			}
+		default:
+			sb.WriteRune(r)
+		}
+	}
+}
+
+func (l *lexer) lexAtom() (token, error) {
+	start, begin := l.pos, l.offset
+	for !l.eof() && !isDelimiter(l.peek()) {
+		l.advance()
+	}
+	text := l.src[begin:l.offset]
+	if !looksNumeric(text) {
+		return token{kind: tokenSymbol, text: text, pos: start}, nil
+	}
+	if n, ok := parseNumber(text); ok {
+		return token{kind: tokenNumber, text: text, value: n, pos: start}, nil
+	}
+	return token{}, &SyntaxError{Pos: start, Token: text, Msg: "invalid number"}
+}
+
+// looksNumeric reports whether an atom starts like a number: a digit, optionally preceded by a sign or a dot.
+func looksNumeric(s string) bool {
+	if s != "" && (s[0] == '-' || s[0] == '+') {
+		s = s[1:]
+	}
+	if s != "" && s[0] == '.' {
+		s = s[1:]
+	}
+	return s != "" && s[0] >= '0' && s[0] <= '9'
+}
+
+func isSpace(r rune) bool {
+	return r == ' ' || r == '\t' || r == '\n' || r == '\r'
+}
+
+func isDelimiter(r rune) bool {
+	return isSpace(r) || r == '(' || r == ')' || r == '"' || r == ';'
+}
@@ -0,0 +1,69 @@
+package ast
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseExpression(t *testing.T) {
+	tests := []struct {
+		src  string
+		want Expression
+	}{
+		{`(== name "hello world")`, []interface{}{Symbol("=="), Symbol("name"), "hello world"}},
+		{`(== name "a (b) \"c\"\n")`, []interface{}{Symbol("=="), Symbol("name"), "a (b) \"c\"\n"}},
+		{`(in x (-1 2.5 -3e2 +4 .5))`, []interface{}{Symbol("in"), Symbol("x"), []interface{}{-1, 2.5, -300.0, 4, 0.5}}},
+		{"; routing rule\n(and a ; trailing comment\n b)", []interface{}{Symbol("and"), Symbol("a"), Symbol("b")}},
+		{`(== x "é")`, []interface{}{Symbol("=="), Symbol("x"), "é"}},
+		{`inf`, Symbol("inf")},
+	}
+	for _, tt := range tests {
+		got, err := ParseExpression(tt.src)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.src, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: expected %#v, got %#v", tt.src, tt.want, got)
+		}
+	}
+}
+
+func TestParseExpressionErrors(t *testing.T) {
+	tests := []struct {
+		src   string
+		pos   Pos
+		token string
+	}{
+		{`(== a b))`, Pos{1, 9}, ")"},
+		{"(and\n  (== a 1)", Pos{1, 1}, "("},
+		{"(== a\n  \"abc)", Pos{2, 3}, `"abc)`},
+		{`(== a "\q")`, Pos{1, 8}, `\q`},
+		{`(== a 1.2.3)`, Pos{1, 7}, "1.2.3"},
+		{`)`, Pos{1, 1}, ")"},
+		{`  ; only a comment`, Pos{1, 19}, ""},
+	}
+	for _, tt := range tests {
+		_, err := ParseExpression(tt.src)
+		var syntaxErr *SyntaxError
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("%q: expected a SyntaxError, got %v", tt.src, err)
+			continue
+		}
+		if syntaxErr.Pos != tt.pos || syntaxErr.Token != tt.token {
+			t.Errorf("%q: expected %s near %q, got %v", tt.src, tt.pos, tt.token, err)
+		}
+	}
+}
+
+func TestCompileStringErrorPositions(t *testing.T) {
+	_, err := CompileString("(and\n  (== a 1)\n  (foo b))")
+	var errs CompileErrors
+	if !errors.As(err, &errs) || len(errs) != 1 {
+		t.Fatalf("expected one compile error, got %v", err)
+	}
+	if errs[0].Pos != (Pos{3, 3}) {
+		t.Errorf("expected error at 3:3, got %v", errs[0])
+	}
+}
@@ -0,0 +1,167 @@
+package ast
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Library holds named predicates, conditions shared by many expressions such as "is paying customer",
+// that expressions refer to with (ref name), e.g. (and (ref is_paying) (> amount 100)).
+// References are expanded into the predicates they name when an expression is compiled with WithLibrary,
+// so that they cost nothing at evaluation. A Library is safe for concurrent use.
+type Library struct {
+	mu         sync.RWMutex
+	predicates map[string]Expression
+}
+
+// NewLibrary returns an empty library of predicates.
+func NewLibrary() *Library {
+	return &Library{predicates: make(map[string]Expression)}
+}
+
+// Define defines, or redefines, the predicate name as the condition expr.
+// expr may refer to other predicates of the library, which must be defined first.
+// It returns CompileErrors if expr is not a valid condition, refers to an unknown predicate,
+// or refers back to name, directly or through other predicates.
+func (l *Library) Define(name string, expr Expression) error {
+	if name == "" || strings.ContainsAny(name, " ()\"") {
+		return fmt.Errorf("invalid predicate name %q", name)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	x := &expander{predicates: l.predicates, budget: budget{limits: DefaultLimits}, stack: []string{name}}
+	expanded, err := x.run(expr)
+	if err != nil {
+		return err
+	}
+	// predicates may use windowed aggregates, which keep their state in the windows of the programs referring to them
+	if _, err := Compile(expanded, WithWindows(NewWindows(0), name)); err != nil {
+		return err
+	}
+	l.predicates[name] = expr
+	return nil
+}
+
+// Lookup returns the expression of a predicate.
+func (l *Library) Lookup(name string) (Expression, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	expr, ok := l.predicates[name]
+	return expr, ok
+}
+
+// Names returns the names of the predicates of the library, sorted.
+func (l *Library) Names() []string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	names := make([]string, 0, len(l.predicates))
+	for name := range l.predicates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Expand returns expr with every reference replaced by the predicate it names, recursively.
+func (l *Library) Expand(expr Expression) (Expression, error) {
+	return l.expand(expr, DefaultLimits)
+}
+
+// expand is Expand, stopping with a LimitError once the expansion exceeds the maximum number of nodes,
+// since a few predicates referring to each other several times can expand exponentially.
+func (l *Library) expand(expr Expression, limits Limits) (Expression, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	x := &expander{predicates: l.predicates, budget: budget{limits: limits}}
+	return x.run(expr)
+}
+
+// expand expands the references of expr when a library is configured.
+func (cfg *optconfig) expand(expr Expression) (Expression, error) {
+	if cfg.library == nil {
+		return expr, nil
+	}
+	return cfg.library.expand(expr, cfg.limits)
+}
+
+type expander struct {
+	predicates map[string]Expression
+	budget     budget
+	stack      []string // the predicates being expanded, to detect cycles
+	at         string   // the path of the outermost reference being expanded, at which errors are reported
+	errs       CompileErrors
+	limitErr   error
+}
+
+func (x *expander) run(expr Expression) (Expression, error) {
+	expanded := x.expand("$", expr)
+	if x.limitErr != nil {
+		return nil, x.limitErr
+	}
+	if len(x.errs) > 0 {
+		return nil, x.errs
+	}
+	return expanded, nil
+}
+
+// expand expands expr, found at path. Errors in the predicates a reference expands to are reported at the reference.
+func (x *expander) expand(path string, expr Expression) Expression {
+	if x.limitErr != nil {
+		return nil
+	}
+	if err := x.budget.node(path, Pos{}); err != nil {
+		x.limitErr = err
+		return nil
+	}
+	e, ok := expr.([]interface{})
+	if !ok {
+		return expr
+	}
+	if len(e) > 0 && e[0] == Symbol("ref") {
+		return x.ref(path, e)
+	}
+	expanded := make([]interface{}, len(e))
+	for i, item := range e {
+		expanded[i] = x.expand(fmt.Sprintf("%s[%d]", path, i), item)
+	}
+	return expanded
+}
+
+func (x *expander) ref(path string, e []interface{}) Expression {
+	if len(e) != 2 {
+		x.errorf(path, "ref expects 1 operand, got %d", len(e)-1)
+		return e
+	}
+	name, ok := e[1].(Symbol)
+	if !ok {
+		x.errorf(path, "ref expects the name of a predicate, got %#v", e[1])
+		return e
+	}
+	for i, s := range x.stack {
+		if s == string(name) {
+			x.errorf(path, "predicate %s refers to itself: %s -> %s", name, strings.Join(x.stack[i:], " -> "), name)
+			return e
+		}
+	}
+	body, ok := x.predicates[string(name)]
+	if !ok {
+		x.errorf(path, "unknown predicate %s", name)
+		return e
+	}
+	if x.at == "" {
+		x.at = path
+		defer func() { x.at = "" }()
+	}
+	x.stack = append(x.stack, string(name))
+	defer func() { x.stack = x.stack[:len(x.stack)-1] }()
+	return x.expand(path, body)
+}
+
+func (x *expander) errorf(path string, format string, args ...interface{}) {
+	if x.at != "" {
+		path = x.at
+	}
+	x.errs = append(x.errs, &CompileError{Path: path, Msg: fmt.Sprintf(format, args...)})
+}
@@ -0,0 +1,110 @@
+package ast
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func mustDefine(t *testing.T, lib *Library, name, s string) {
+	t.Helper()
+	expr, err := ParseExpression(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lib.Define(name, expr); err != nil {
+		t.Fatalf("define %s: %v", name, err)
+	}
+}
+
+func TestLibraryRef(t *testing.T) {
+	lib := NewLibrary()
+	mustDefine(t, lib, "is_paying", `(in plan ("pro" "enterprise"))`)
+	mustDefine(t, lib, "is_internal", `(ends_with email "@example.com")`)
+	mustDefine(t, lib, "is_customer", `(and (ref is_paying) (not (ref is_internal)))`)
+
+	p, err := CompileString(`(and (ref is_customer) (> amount 100))`, WithLibrary(lib))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := ParseExpression(`(and (and (in plan ("pro" "enterprise")) (not (ends_with email "@example.com"))) (> amount 100))`)
+	if got, _ := lib.Expand(p.Expression()); !reflect.DeepEqual(got, want) {
+		t.Errorf("expanded to %v, want %v", got, want)
+	}
+
+	tests := []struct {
+		event map[string]interface{}
+		want  bool
+	}{
+		{map[string]interface{}{"plan": "pro", "email": "a@b.org", "amount": 150}, true},
+		{map[string]interface{}{"plan": "pro", "email": "a@example.com", "amount": 150}, false},
+		{map[string]interface{}{"plan": "free", "email": "a@b.org", "amount": 150}, false},
+		{map[string]interface{}{"plan": "pro", "email": "a@b.org", "amount": 50}, false},
+	}
+	for _, tt := range tests {
+		got, err := p.Evaluate(tt.event)
+		if err != nil || got != tt.want {
+			t.Errorf("Program.Evaluate(%v) = %v, %v, want %v", tt.event, got, err, tt.want)
+		}
+		got, err = Evaluate(p.Expression(), tt.event, WithLibrary(lib))
+		if err != nil || got != tt.want {
+			t.Errorf("Evaluate(%v) = %v, %v, want %v", tt.event, got, err, tt.want)
+		}
+	}
+
+	// the program keeps the predicates it was compiled with
+	mustDefine(t, lib, "is_paying", `(== plan "free")`)
+	if ok, _ := p.Evaluate(tests[0].event); !ok {
+		t.Error("redefining a predicate changed a compiled program")
+	}
+}
+
+func TestLibraryErrors(t *testing.T) {
+	lib := NewLibrary()
+	mustDefine(t, lib, "a", `(== x 1)`)
+	mustDefine(t, lib, "b", `(ref a)`)
+
+	expr, _ := ParseExpression(`(ref b)`)
+	err := lib.Define("a", expr)
+	if err == nil || err.Error() != "$: predicate a refers to itself: a -> b -> a" {
+		t.Errorf("cycle: got %v", err)
+	}
+	expr, _ = ParseExpression(`(ref c)`)
+	if err := lib.Define("c", expr); err == nil {
+		t.Error("defined a predicate referring to itself")
+	}
+	if err := lib.Define("d", expr); err == nil || err.Error() != "$: unknown predicate c" {
+		t.Errorf("unknown predicate: got %v", err)
+	}
+	expr, _ = ParseExpression(`(+ x 1)`)
+	if err := lib.Define("e", expr); err == nil {
+		t.Error("defined a predicate that is not a condition")
+	}
+
+	_, err = CompileString("(and (== y 2)\n  (ref missing))", WithLibrary(lib))
+	var errs CompileErrors
+	if !errors.As(err, &errs) || len(errs) != 1 || errs[0].Pos.Line != 2 || errs[0].Msg != "unknown predicate missing" {
+		t.Errorf("unknown predicate in a program: got %v", err)
+	}
+	if _, err := CompileString(`(ref a)`); err == nil || err.Error() != "1:1: ref needs a library of predicates, see WithLibrary" {
+		t.Errorf("without a library: got %v", err)
+	}
+}
+
+func TestLibraryExpansionLimit(t *testing.T) {
+	lib := NewLibrary()
+	mustDefine(t, lib, "p0", `(== x 1)`)
+	names := []string{"p0"}
+	for i := 1; i < 10; i++ {
+		prev := names[i-1]
+		name := fmt.Sprintf("p%d", i)
+		mustDefine(t, lib, name, "(or (ref "+prev+") (ref "+prev+"))")
+		names = append(names, name)
+	}
+	expr, _ := ParseExpression("(ref " + names[len(names)-1] + ")")
+	var limitErr *LimitError
+	if _, err := Compile(expr, WithLibrary(lib), WithLimits(Limits{MaxNodes: 1000})); !errors.As(err, &limitErr) || limitErr.Limit != "nodes" {
+		t.Errorf("got %v, want a nodes LimitError", err)
+	}
+}
@@ -0,0 +1,102 @@
+package ast
+
+import "fmt"
+
+// Limits bound the size of expressions, which may be written by untrusted users, so that parsing,
+// compiling and evaluating them takes bounded time and memory and cannot overflow the stack.
+// A zero limit means no limit.
+type Limits struct {
+	MaxDepth   int // the maximum nesting depth of calls and lists; the root call is at depth 1
+	MaxNodes   int // the maximum number of nodes: operators, identifiers, literals, calls and lists
+	MaxListLen int // the maximum number of items of a list, or of operands of a call
+}
+
+// DefaultLimits are the limits of expressions unless WithLimits is given.
+// They are generous for rules written by hand while protecting against pathological input.
+var DefaultLimits = Limits{MaxDepth: 100, MaxNodes: 100000, MaxListLen: 10000}
+
+// WithLimits sets the limits of the size of expressions that are parsed, compiled or evaluated.
+func WithLimits(limits Limits) Option {
+	return option(func(cfg *optconfig) {
+		cfg.limits = limits
+	})
+}
+
+// LimitError is returned when an expression exceeds one of its Limits.
+type LimitError struct {
+	Limit string // "depth", "nodes" or "list length"
+	Max   int
+	Path  string // the node at which the limit was exceeded, as in CompileError
+	Pos   Pos    // its position in the source, when parsed from text
+}
+
+func (e *LimitError) Error() string {
+	where := e.Path
+	if e.Pos.IsValid() {
+		where = e.Pos.String()
+	}
+	return fmt.Sprintf("%s: expression exceeds the maximum %s of %d", where, e.Limit, e.Max)
+}
+
+// budget counts the size of an expression against limits as it is parsed or walked.
+type budget struct {
+	limits Limits
+	nodes  int
+}
+
+// node counts a node.
+func (b *budget) node(path string, pos Pos) error {
+	b.nodes++
+	if b.limits.MaxNodes > 0 && b.nodes > b.limits.MaxNodes {
+		return &LimitError{Limit: "nodes", Max: b.limits.MaxNodes, Path: path, Pos: pos}
+	}
+	return nil
+}
+
+// nest checks the depth of a call or list.
+func (b *budget) nest(depth int, path string, pos Pos) error {
+	if b.limits.MaxDepth > 0 && depth > b.limits.MaxDepth {
+		return &LimitError{Limit: "depth", Max: b.limits.MaxDepth, Path: path, Pos: pos}
+	}
+	return nil
+}
+
+// items checks the number of items of a list, or of operands of a call.
+func (b *budget) items(n int, path string, pos Pos) error {
+	if b.limits.MaxListLen > 0 && n > b.limits.MaxListLen {
+		return &LimitError{Limit: "list length", Max: b.limits.MaxListLen, Path: path, Pos: pos}
+	}
+	return nil
+}
+
+// checkLimits checks that an expression is within limits, without descending deeper than allowed.
+func checkLimits(expr Expression, limits Limits) error {
+	b := &budget{limits: limits}
+	return b.walk(expr, "$", 1)
+}
+
+func (b *budget) walk(expr Expression, path string, depth int) error {
+	if err := b.node(path, Pos{}); err != nil {
+		return err
+	}
+	e, ok := expr.([]interface{})
+	if !ok {
+		return nil
+	}
+	if err := b.nest(depth, path, Pos{}); err != nil {
+		return err
+	}
+	n := len(e)
+	if isCall(e) {
+		n--
+	}
+	if err := b.items(n, path, Pos{}); err != nil {
+		return err
+	}
+	for i, item := range e {
+		if err := b.walk(item, fmt.Sprintf("%s[%d]", path, i), depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
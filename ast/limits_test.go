@@ -0,0 +1,113 @@
+package ast
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLimitsDepth(t *testing.T) {
+	deep := strings.Repeat("(not ", 10000) + "ok" + strings.Repeat(")", 10000)
+	deepInfix := strings.Repeat("(", 10000) + "ok" + strings.Repeat(")", 10000)
+	deepJSON := strings.Repeat(`["not", `, 5000) + `"ok"` + strings.Repeat("]", 5000)
+	parsers := map[string]func() error{
+		"sexpr": func() error { _, err := CompileString(deep); return err },
+		"infix": func() error { _, err := CompileInfix(deepInfix); return err },
+		"json":  func() error { _, err := CompileJSON([]byte(deepJSON)); return err },
+	}
+	for name, parse := range parsers {
+		err := parse()
+		var limitErr *LimitError
+		if !errors.As(err, &limitErr) || limitErr.Limit != "depth" || limitErr.Max != DefaultLimits.MaxDepth {
+			t.Errorf("%s: got %v, want a depth LimitError", name, err)
+		}
+	}
+
+	// the depth of the root call is 1
+	expr := "(not (not (not ok)))"
+	if _, err := CompileString(expr, WithLimits(Limits{MaxDepth: 3})); err != nil {
+		t.Errorf("depth 3: %v", err)
+	}
+	_, err := CompileString(expr, WithLimits(Limits{MaxDepth: 2}))
+	if err == nil || err.Error() != "1:11: expression exceeds the maximum depth of 2" {
+		t.Errorf("depth 2: got %v", err)
+	}
+	if _, err := CompileString(deep, WithLimits(Limits{})); err != nil {
+		t.Errorf("no limits: %v", err)
+	}
+}
+
+func TestLimitsNodesAndListLength(t *testing.T) {
+	list := func(n int) string {
+		return `(in country (` + strings.Repeat(`"DE" `, n) + `))`
+	}
+	limits := WithLimits(Limits{MaxNodes: 20, MaxListLen: 10})
+	if _, err := CompileString(list(10), limits); err != nil {
+		t.Errorf("list of 10: %v", err)
+	}
+	var limitErr *LimitError
+	if _, err := CompileString(list(11), limits); !errors.As(err, &limitErr) || limitErr.Limit != "list length" {
+		t.Errorf("list of 11: got %v, want a list length LimitError", err)
+	}
+	if _, err := CompileInfix(`country in [`+strings.Repeat(`"DE", `, 11)+`"FR"]`, limits); !errors.As(err, &limitErr) || limitErr.Limit != "list length" {
+		t.Errorf("infix list of 12: got %v, want a list length LimitError", err)
+	}
+
+	// the operands of a call are limited as lists
+	call := "(and" + strings.Repeat(" ok", 11) + ")"
+	if _, err := CompileString(call, limits); !errors.As(err, &limitErr) || limitErr.Limit != "list length" {
+		t.Errorf("call with 11 operands: got %v, want a list length LimitError", err)
+	}
+
+	expr := `(or ` + strings.Repeat(`(== a 1) `, 6) + `)`
+	if _, err := CompileString(expr, limits); !errors.As(err, &limitErr) || limitErr.Limit != "nodes" {
+		t.Errorf("25 nodes: got %v, want a nodes LimitError", err)
+	}
+
+	// expressions built in Go are checked when compiled and evaluated
+	built := []interface{}{Symbol("or")}
+	for i := 0; i < 6; i++ {
+		built = append(built, []interface{}{Symbol("=="), Symbol("a"), 1})
+	}
+	if _, err := Compile(built, limits); !errors.As(err, &limitErr) {
+		t.Errorf("Compile: got %v, want a LimitError", err)
+	}
+	if _, err := Evaluate(built, nil, limits); !errors.As(err, &limitErr) {
+		t.Errorf("Evaluate: got %v, want a LimitError", err)
+	}
+}
+
+func TestEvaluateContextCanceled(t *testing.T) {
+	items := make([]interface{}, 1000)
+	for i := range items {
+		items[i] = map[string]interface{}{"price": i}
+	}
+	event := map[string]interface{}{"items": items}
+	expr, err := ParseExpression("(all (>= items[*].price 0))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := Compile(expr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if ok, err := p.EvaluateContext(ctx, event); !ok || err != nil {
+		t.Fatalf("got %v, %v", ok, err)
+	}
+	if ok, err := EvaluateContext(ctx, expr, event); !ok || err != nil {
+		t.Fatalf("got %v, %v", ok, err)
+	}
+	cancel()
+	if _, err := p.EvaluateContext(ctx, event); !errors.Is(err, context.Canceled) {
+		t.Errorf("Program: got %v, want context.Canceled", err)
+	}
+	if _, err := EvaluateContext(ctx, expr, event); !errors.Is(err, context.Canceled) {
+		t.Errorf("Evaluate: got %v, want context.Canceled", err)
+	}
+	if _, err := p.ExplainContext(ctx, event); !errors.Is(err, context.Canceled) {
+		t.Errorf("Explain: got %v, want context.Canceled", err)
+	}
+}
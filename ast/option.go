@@ -0,0 +1,92 @@
+package ast
+
+import "time"
+
+type Option interface {
+	apply(cfg *optconfig)
+}
+
+type option func(cfg *optconfig)
+
+func (fn option) apply(cfg *optconfig) {
+	fn(cfg)
+}
+
+type optconfig struct {
+	coercion Coercion
+	schema   Schema
+	clock    Clock
+	location *time.Location
+	windows  *Windows
+	scope    string
+	limits   Limits
+	library  *Library
+}
+
+func defaultConfig() *optconfig {
+	return &optconfig{
+		coercion: CoercionLenient,
+		clock:    SystemClock,
+		location: time.UTC,
+		limits:   DefaultLimits,
+	}
+}
+
+func newConfig(opts []Option) *optconfig {
+	cfg := defaultConfig()
+	for _, opt := range opts {
+		opt.apply(cfg)
+	}
+	return cfg
+}
+
+// WithCoercion sets how values of different types are converted when they are compared
+// or used in arithmetic. The default is CoercionLenient.
+func WithCoercion(coercion Coercion) Option {
+	return option(func(cfg *optconfig) {
+		cfg.coercion = coercion
+	})
+}
+
+// WithSchema types the fields of the event according to schema before evaluating,
+// e.g. so that a "score" property sent as "51" is a number.
+func WithSchema(schema Schema) Option {
+	return option(func(cfg *optconfig) {
+		cfg.schema = schema
+	})
+}
+
+// WithClock sets the clock that time-aware functions such as now and within_last tell the time with,
+// e.g. a fixed clock in tests. The default is the SystemClock.
+func WithClock(clock Clock) Option {
+	return option(func(cfg *optconfig) {
+		cfg.clock = clock
+	})
+}
+
+// WithLocation sets the time zone of functions such as hour_of_day when they are not given one.
+// The default is UTC.
+func WithLocation(loc *time.Location) Option {
+	return option(func(cfg *optconfig) {
+		cfg.location = loc
+	})
+}
+
+// WithWindows keeps the state of the windowed aggregates of the expression, such as window_count, in windows.
+// scope tells apart the aggregates of different rules sharing windows, e.g. the ID of the rule.
+// Every evaluation of an aggregate, including when explaining, records the event in its window.
+// Compile rejects aggregates without windows.
+func WithWindows(windows *Windows, scope string) Option {
+	return option(func(cfg *optconfig) {
+		cfg.windows = windows
+		cfg.scope = scope
+	})
+}
+
+// WithLibrary expands the references of the expression, such as (ref is_paying), into the predicates of lib
+// they name. The expression is expanded when it is compiled, so later changes to lib do not affect the program.
+func WithLibrary(lib *Library) Option {
+	return option(func(cfg *optconfig) {
+		cfg.library = lib
+	})
+}
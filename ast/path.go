@@ -0,0 +1,169 @@
+package ast
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// pathSegment is one step of a field path: a key of an object, an index of an array,
+// or the wildcard [*] that stands for every element of an array.
+type pathSegment struct {
+	key      string
+	index    int
+	isIndex  bool
+	wildcard bool
+	end      int // offset in the path just after this segment, so path[:end] is the prefix up to it
+}
+
+// parsePath parses a field path such as user.address.city, items[0].sku, items[-1] or items[*].price.
+func parsePath(s string) ([]pathSegment, error) {
+	var segments []pathSegment
+	i := 0
+	for i < len(s) {
+		switch {
+		case s[i] == '[':
+			j := strings.IndexByte(s[i:], ']')
+			if j < 0 {
+				return nil, fmt.Errorf("invalid path %s: missing ]", s)
+			}
+			inner := s[i+1 : i+j]
+			seg := pathSegment{isIndex: true, end: i + j + 1}
+			if inner == "*" {
+				seg.wildcard = true
+			} else {
+				index, err := strconv.Atoi(inner)
+				if err != nil {
+					return nil, fmt.Errorf("invalid path %s: invalid index %q", s, inner)
+				}
+				seg.index = index
+			}
+			segments = append(segments, seg)
+			i = seg.end
+		case s[i] == '.' && len(segments) > 0:
+			i++
+			fallthrough
+		default:
+			j := i
+			for j < len(s) && s[j] != '.' && s[j] != '[' && s[j] != ']' {
+				j++
+			}
+			if j == i {
+				return nil, fmt.Errorf("invalid path %s: empty key at offset %d", s, i)
+			}
+			segments = append(segments, pathSegment{key: s[i:j], end: j})
+			i = j
+		}
+	}
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("empty path")
+	}
+	return segments, nil
+}
+
+// isPath reports whether the name needs to be parsed as a path rather than used as a plain key.
+func isPath(name string) bool {
+	return strings.ContainsAny(name, ".[")
+}
+
+// wildcardPrefixes returns the prefix of the path up to and including each of its wildcards,
+// e.g. orders[*] and orders[*].items[*] for orders[*].items[*].sku.
+func wildcardPrefixes(name string) []string {
+	if !strings.Contains(name, "[*]") {
+		return nil
+	}
+	segments, err := parsePath(name)
+	if err != nil {
+		return nil
+	}
+	var prefixes []string
+	for _, seg := range segments {
+		if seg.wildcard {
+			prefixes = append(prefixes, name[:seg.end])
+		}
+	}
+	return prefixes
+}
+
+// lookup resolves a field of the event by name. A name that is a key of the event is used as is,
+// so flat keys containing dots keep working; otherwise it is resolved as a path.
+// Wildcards are resolved to the element currently bound to them by an enclosing any or all.
+func lookup(event map[string]interface{}, name string, bindings map[string]int) (interface{}, bool, error) {
+	if value, ok := event[name]; ok {
+		return value, true, nil
+	}
+	if !isPath(name) {
+		return nil, false, nil
+	}
+	segments, err := parsePath(name)
+	if err != nil {
+		return nil, false, err
+	}
+	var current interface{} = event
+	for _, seg := range segments {
+		var ok bool
+		switch {
+		case seg.wildcard:
+			index, bound := bindings[name[:seg.end]]
+			if !bound {
+				return nil, false, fmt.Errorf("wildcard %s used outside of any or all", name[:seg.end])
+			}
+			current, ok = elementAt(current, index)
+		case seg.isIndex:
+			current, ok = elementAt(current, seg.index)
+		default:
+			current, ok = fieldOf(current, seg.key)
+		}
+		if !ok {
+			return nil, false, nil
+		}
+	}
+	return current, true, nil
+}
+
+func fieldOf(v interface{}, key string) (interface{}, bool) {
+	switch m := v.(type) {
+	case map[string]interface{}:
+		value, ok := m[key]
+		return value, ok
+	case map[string]string:
+		value, ok := m[key]
+		return value, ok
+	}
+	return nil, false
+}
+
+// elementAt returns the element of an array at index. Negative indexes count from the end.
+func elementAt(v interface{}, index int) (interface{}, bool) {
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, false
+	}
+	if index < 0 {
+		index += len(list)
+	}
+	if index < 0 || index >= len(list) {
+		return nil, false
+	}
+	return list[index], true
+}
+
+// quantifiedPrefix returns the wildcard prefix bound by a quantifier over expr:
+// the first wildcard prefix in expr that is not already bound.
+func quantifiedPrefix(expr Expression, bound func(prefix string) bool) (string, bool) {
+	switch e := expr.(type) {
+	case []interface{}:
+		for _, item := range e {
+			if prefix, ok := quantifiedPrefix(item, bound); ok {
+				return prefix, true
+			}
+		}
+	case Symbol:
+		for _, prefix := range wildcardPrefixes(string(e)) {
+			if !bound(prefix) {
+				return prefix, true
+			}
+		}
+	}
+	return "", false
+}
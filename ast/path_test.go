@@ -0,0 +1,79 @@
+package ast
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+const order = `{
+	"user": {"address": {"city": "Berlin"}},
+	"status.code": "ok",
+	"items": [
+		{"sku": "A1", "price": 50, "tags": ["new"]},
+		{"sku": "B2", "price": 150, "tags": ["sale", "new"]}
+	],
+	"orders": [
+		{"items": [{"sku": "A1"}]},
+		{"items": [{"sku": "C3"}, {"sku": "D4"}]}
+	]
+}`
+
+func TestEvaluatePaths(t *testing.T) {
+	var event map[string]interface{}
+	if err := json.Unmarshal([]byte(order), &event); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{`(== user.address.city "Berlin")`, true},
+		{`(== status.code "ok")`, true},
+		{`(== items[0].sku "A1")`, true},
+		{`(== items[-1].sku "B2")`, true},
+		{`(== items[1].tags[0] "sale")`, true},
+		{`(any (> items[*].price 100))`, true},
+		{`(all (> items[*].price 100))`, false},
+		{`(all (> items[*].price 10))`, true},
+		{`(any (and (== items[*].sku "B2") (< items[*].price 100)))`, false},
+		{`(any (in items[*].sku ("X" "B2")))`, true},
+		{`(all (== missing[*].sku "A1"))`, true},
+		{`(any (== missing[*].sku "A1"))`, false},
+		{`(any (any (== orders[*].items[*].sku "D4")))`, true},
+		{`(all (any (== orders[*].items[*].sku "A1")))`, false},
+		{`(any (all (!= orders[*].items[*].sku "A1")))`, true},
+	}
+	for _, tt := range tests {
+		p, err := CompileString(tt.expr)
+		if err != nil {
+			t.Errorf("%s: compile: %v", tt.expr, err)
+			continue
+		}
+		got, err := p.Evaluate(event)
+		if err != nil {
+			t.Errorf("%s: evaluate: %v", tt.expr, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: expected %v, got %v", tt.expr, tt.want, got)
+		}
+	}
+}
+
+func TestCompilePathErrors(t *testing.T) {
+	tests := []string{
+		`(== items[*].sku "A1")`,
+		`(any (== items[0].sku "A1"))`,
+		`(any (== orders[*].items[*].sku "A1"))`,
+		`(== items[x] 1)`,
+		`(== items..sku 1)`,
+	}
+	for _, expr := range tests {
+		_, err := CompileString(expr)
+		var errs CompileErrors
+		if !errors.As(err, &errs) {
+			t.Errorf("%s: expected compile errors, got %v", expr, err)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package ast
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mntwo/tasklab/encoding"
+)
+
+// Clock tells the time to time-aware functions such as now and within_last.
+type Clock interface {
+	Now() time.Time
+}
+
+// ClockFunc adapts a function to a Clock.
+type ClockFunc func() time.Time
+
+func (f ClockFunc) Now() time.Time {
+	return f()
+}
+
+// SystemClock is the Clock of the system, used by default.
+var SystemClock Clock = ClockFunc(time.Now)
+
+type configKey struct{}
+
+// Now returns the current time of the evaluation that ctx belongs to, for use by functions registered
+// with RegisterFunc. It is the time of the Clock given WithClock, or else of the SystemClock.
+func Now(ctx context.Context) time.Time {
+	if cfg, ok := ctx.Value(configKey{}).(*optconfig); ok && cfg.clock != nil {
+		return cfg.clock.Now()
+	}
+	return SystemClock.Now()
+}
+
+// location returns the time zone of the evaluation that ctx belongs to.
+func location(ctx context.Context) *time.Location {
+	if cfg, ok := ctx.Value(configKey{}).(*optconfig); ok && cfg.location != nil {
+		return cfg.location
+	}
+	return time.UTC
+}
+
+func init() {
+	registerFunc("within_last", 2, 2, funcWithinLast, checkDurationArg)
+	registerFunc("hour_of_day", 1, 2, funcHourOfDay, checkLocationArg)
+	registerFunc("day_of_week", 1, 2, funcDayOfWeek, checkLocationArg)
+	registerFunc("business_hours", 1, 4, funcBusinessHours, checkBusinessHoursArgs)
+}
+
+// FromPayload converts a payload to an event: its properties, plus its timestamp as ts,
+// its event name as event and its project as project, which take precedence over properties of the same name.
+func FromPayload(p encoding.Payload) map[string]interface{} {
+	return FromPayloadProperties(p, p.GetProperties())
+}
+
+// FromPayloadProperties is FromPayload with other properties than those of the payload,
+// such as the properties of the payload once transformed.
+func FromPayloadProperties(p encoding.Payload, properties map[string]string) map[string]interface{} {
+	event := FromProperties(properties)
+	event["ts"] = p.GetTs()
+	event["event"] = p.GetEvent()
+	event["project"] = p.GetProject()
+	return event
+}
+
+// toTime converts a timestamp to a time. Numbers, and strings of digits as sent in properties,
+// are Unix milliseconds like payload timestamps; other strings must be RFC 3339 times.
+func toTime(v interface{}) (time.Time, error) {
+	switch t := v.(type) {
+	case time.Time:
+		return t, nil
+	case string:
+		if n, ok := parseNumber(strings.TrimSpace(t)); ok {
+			return toTime(n)
+		}
+		parsed, err := time.Parse(time.RFC3339, t)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid time %q", t)
+		}
+		return parsed, nil
+	}
+	ms, ok := toFloat(v)
+	if !ok {
+		return time.Time{}, fmt.Errorf("invalid time %v (%T)", v, v)
+	}
+	return time.UnixMilli(int64(ms)), nil
+}
+
+// parseDuration parses a duration such as "90s", "5m", "1h30m", or with the units d for days and w for weeks, "7d".
+func parseDuration(s string) (time.Duration, error) {
+	for _, unit := range []struct {
+		suffix string
+		d      time.Duration
+	}{{"d", 24 * time.Hour}, {"w", 7 * 24 * time.Hour}} {
+		if n, ok := strings.CutSuffix(s, unit.suffix); ok {
+			count, err := strconv.Atoi(n)
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration %q", s)
+			}
+			return time.Duration(count) * unit.d, nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
+
+// funcWithinLast reports whether a timestamp is within the given duration before now, e.g. (within_last ts "5m").
+func funcWithinLast(ctx context.Context, args ...interface{}) (interface{}, error) {
+	if args[0] == nil {
+		return false, nil
+	}
+	t, err := toTime(args[0])
+	if err != nil {
+		return nil, err
+	}
+	s, ok := args[1].(string)
+	if !ok {
+		return nil, fmt.Errorf("within_last: expected a duration, got %v", args[1])
+	}
+	d, err := parseDuration(s)
+	if err != nil {
+		return nil, err
+	}
+	now := Now(ctx)
+	return !t.After(now) && now.Sub(t) <= d, nil
+}
+
+// funcHourOfDay returns the hour of a timestamp, from 0 to 23, in the given time zone or else
+// in the time zone of the evaluation, e.g. (hour_of_day ts "Europe/Berlin").
+func funcHourOfDay(ctx context.Context, args ...interface{}) (interface{}, error) {
+	t, ok, err := localTime(ctx, args)
+	if !ok {
+		return nil, err
+	}
+	return t.Hour(), nil
+}
+
+// funcDayOfWeek returns the ISO 8601 day of the week of a timestamp, from 1 for Monday to 7 for Sunday,
+// in the given time zone or else in the time zone of the evaluation.
+func funcDayOfWeek(ctx context.Context, args ...interface{}) (interface{}, error) {
+	t, ok, err := localTime(ctx, args)
+	if !ok {
+		return nil, err
+	}
+	if t.Weekday() == time.Sunday {
+		return 7, nil
+	}
+	return int(t.Weekday()), nil
+}
+
+// funcBusinessHours reports whether a timestamp is on a weekday between the opening and closing times
+// in the given time zone, by default from "09:00" to "17:00",
+// e.g. (business_hours ts "Europe/Berlin") or (business_hours ts "America/New_York" "08:30" "18:00").
+func funcBusinessHours(ctx context.Context, args ...interface{}) (interface{}, error) {
+	if len(args) == 3 {
+		return nil, fmt.Errorf("business_hours: expected both an opening and a closing time")
+	}
+	t, ok, err := localTime(ctx, args[:min(len(args), 2)])
+	if !ok {
+		return false, err
+	}
+	open, closing := "09:00", "17:00"
+	if len(args) == 4 {
+		open, _ = args[2].(string)
+		closing, _ = args[3].(string)
+	}
+	from, err := parseClock(open)
+	if err != nil {
+		return nil, err
+	}
+	to, err := parseClock(closing)
+	if err != nil {
+		return nil, err
+	}
+	if t.Weekday() == time.Saturday || t.Weekday() == time.Sunday {
+		return false, nil
+	}
+	minutes := t.Hour()*60 + t.Minute()
+	return minutes >= from && minutes < to, nil
+}
+
+// localTime converts the timestamp in args[0] to the time zone in args[1] if any.
+// It returns false without an error when the timestamp is null.
+func localTime(ctx context.Context, args []interface{}) (time.Time, bool, error) {
+	if args[0] == nil {
+		return time.Time{}, false, nil
+	}
+	t, err := toTime(args[0])
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	loc := location(ctx)
+	if len(args) > 1 {
+		name, ok := args[1].(string)
+		if !ok {
+			return time.Time{}, false, fmt.Errorf("expected a time zone, got %v", args[1])
+		}
+		if loc, err = loadLocation(name); err != nil {
+			return time.Time{}, false, err
+		}
+	}
+	return t.In(loc), true, nil
+}
+
+// locations caches time zones by name, since time.LoadLocation reads the zoneinfo data on every call.
+// Only valid names are cached, so it holds at most the zones of the zoneinfo database.
+var locations sync.Map
+
+func loadLocation(name string) (*time.Location, error) {
+	if loc, ok := locations.Load(name); ok {
+		return loc.(*time.Location), nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	locations.Store(name, loc)
+	return loc, nil
+}
+
+// parseClock parses a time of day such as "09:30" to minutes after midnight.
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// stringLiteral returns the value of args[i] if it is a string literal.
+func stringLiteral(args []Node, i int) (string, bool) {
+	if i >= len(args) {
+		return "", false
+	}
+	lit, ok := args[i].(*Literal)
+	if !ok {
+		return "", false
+	}
+	s, ok := lit.Value.(string)
+	return s, ok
+}
+
+func checkDurationArg(c *compiler, path string, args []Node) {
+	if s, ok := stringLiteral(args, 1); ok {
+		if _, err := parseDuration(s); err != nil {
+			c.errorf(path+"[2]", "%v", err)
+		}
+	}
+}
+
+func checkLocationArg(c *compiler, path string, args []Node) {
+	if s, ok := stringLiteral(args, 1); ok {
+		if _, err := loadLocation(s); err != nil {
+			c.errorf(path+"[2]", "invalid time zone %q", s)
+		}
+	}
+}
+
+func checkBusinessHoursArgs(c *compiler, path string, args []Node) {
+	if len(args) == 3 {
+		c.errorf(path, "business_hours expects both an opening and a closing time")
+	}
+	checkLocationArg(c, path, args)
+	for i := 2; i < len(args); i++ {
+		if s, ok := stringLiteral(args, i); ok {
+			if _, err := parseClock(s); err != nil {
+				c.errorf(fmt.Sprintf("%s[%d]", path, i+1), "%v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package ast
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mntwo/tasklab/encoding/json"
+)
+
+func TestTimeFuncs(t *testing.T) {
+	// Wednesday 2025-01-15 15:30 UTC, 16:30 in Berlin
+	now := time.Date(2025, 1, 15, 15, 30, 0, 0, time.UTC)
+	clock := ClockFunc(func() time.Time { return now })
+
+	p := json.New()
+	data := `{"event": "login", "ts": ` + strconv.FormatInt(now.Add(-2*time.Minute).UnixMilli(), 10) + `, "properties": {"sent_at": "2025-01-11T10:00:00Z"}}`
+	if err := p.Unmarshal([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	event := FromPayload(p)
+
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{`(within_last ts "5m")`, true},
+		{`(within_last ts "1m")`, false},
+		{`(within_last sent_at "7d")`, true},
+		{`(within_last sent_at "3d")`, false},
+		{`(within_last missing_field "5m")`, false},
+		{`(== (hour_of_day ts) 15)`, true},
+		{`(== (hour_of_day ts "Europe/Berlin") 16)`, true},
+		{`(== (day_of_week ts) 3)`, true},
+		{`(== (day_of_week sent_at) 6)`, true},
+		{`(business_hours ts "Europe/Berlin")`, true},
+		{`(business_hours ts "America/New_York" "11:00" "18:00")`, false},
+		{`(business_hours sent_at "UTC")`, false},
+		{`(> (- (now) ts) 60000)`, true},
+		{`(== event "login")`, true},
+	}
+	for _, tt := range tests {
+		prog, err := CompileString(tt.expr, WithClock(clock))
+		if err != nil {
+			t.Errorf("%s: compile: %v", tt.expr, err)
+			continue
+		}
+		got, err := prog.Evaluate(event)
+		if err != nil {
+			t.Errorf("%s: evaluate: %v", tt.expr, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: expected %v, got %v", tt.expr, tt.want, got)
+		}
+	}
+
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := Evaluate([]interface{}{Symbol("=="), []interface{}{Symbol("hour_of_day"), Symbol("ts")}, 16}, event, WithLocation(berlin)); err != nil || !ok {
+		t.Errorf("expected hour_of_day in the evaluation time zone, got %v, %v", ok, err)
+	}
+
+	for _, expr := range []string{`(within_last ts "5 minutes")`, `(hour_of_day ts "Mars/Olympus")`, `(business_hours ts "UTC" "9am" "17:00")`, `(business_hours ts "UTC" "09:00")`} {
+		if _, err := CompileString(expr); err == nil {
+			t.Errorf("%s: expected a compile error", expr)
+		}
+	}
+}
+
+func TestLoadLocationCache(t *testing.T) {
+	a, err := loadLocation("Europe/Paris")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := loadLocation("Europe/Paris"); a != b {
+		t.Error("loaded Europe/Paris twice")
+	}
+	if _, err := loadLocation("Mars/Olympus"); err == nil {
+		t.Error("loaded an unknown time zone")
+	}
+	if _, ok := locations.Load("Mars/Olympus"); ok {
+		t.Error("cached an unknown time zone")
+	}
+}
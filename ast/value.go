@@ -0,0 +1,66 @@
+package ast
+
+import "context"
+
+// Value is a compiled value expression, such as (* qty price) or (lower country),
+// which computes a value from an event rather than a condition.
+type Value struct {
+	Root  Node
+	expr  Expression
+	cfg   *optconfig
+	eval  valueFn
+	slots int
+}
+
+// CompileValue validates a value expression: an identifier, a literal, arithmetic or a call to a function,
+// and returns a Value, or CompileErrors listing every problem found in it.
+// The options apply to every evaluation of the value.
+func CompileValue(expr Expression, opts ...Option) (*Value, error) {
+	cfg := newConfig(opts)
+	expanded, err := cfg.expand(expr)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkLimits(expanded, cfg.limits); err != nil {
+		return nil, err
+	}
+	c := &compiler{windows: cfg.windows != nil}
+	root := c.compile("$", expanded, kindValue)
+	if len(c.errs) > 0 {
+		return nil, c.errs
+	}
+	v := &Value{Root: root, expr: expr, cfg: cfg}
+	v.eval, v.slots = compileExecValue(root, cfg, c.regexps)
+	return v, nil
+}
+
+// Expression returns the expression the value was compiled from.
+func (v *Value) Expression() Expression {
+	return v.expr
+}
+
+// Evaluate computes the value for an event. Missing fields make arithmetic null, as in conditions.
+// It is safe for concurrent use.
+func (v *Value) Evaluate(event map[string]interface{}) (interface{}, error) {
+	return v.EvaluateContext(context.Background(), event)
+}
+
+// EvaluateContext is Evaluate, stopping with the error of ctx once it is done.
+func (v *Value) EvaluateContext(ctx context.Context, event map[string]interface{}) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if v.cfg.schema != nil {
+		typed, err := v.cfg.schema.Apply(event)
+		if err != nil {
+			return nil, err
+		}
+		event = typed
+	}
+	f := &frame{ctx: context.WithValue(ctx, configKey{}, v.cfg), event: event, slots: make([]int, v.slots)}
+	result, err := v.eval(f)
+	if err != nil {
+		return nil, err
+	}
+	return result.interfaceValue(), nil
+}
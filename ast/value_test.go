@@ -0,0 +1,41 @@
+package ast
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompileValue(t *testing.T) {
+	event := map[string]interface{}{"qty": "3", "price": 2.5, "country": "DE", "items": []interface{}{1, 2, 3}}
+	tests := []struct {
+		expr string
+		want interface{}
+	}{
+		{`(* qty price)`, 7.5},
+		{`(lower country)`, "de"},
+		{`(len items)`, 3},
+		{`(+ missing 1)`, nil},
+		{`"constant"`, "constant"},
+		{`country`, "DE"},
+	}
+	for _, tt := range tests {
+		expr, err := ParseExpression(tt.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := CompileValue(expr)
+		if err != nil {
+			t.Errorf("CompileValue(%s): %v", tt.expr, err)
+			continue
+		}
+		got, err := v.Evaluate(event)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s = %#v, %v, want %#v", tt.expr, got, err, tt.want)
+		}
+	}
+
+	expr, _ := ParseExpression(`(and a b)`)
+	if _, err := CompileValue(expr); err == nil {
+		t.Error("compiled a condition as a value")
+	}
+}
@@ -0,0 +1,210 @@
+package ast
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// windowBuckets is the number of buckets a window is split into. A window slides by one bucket at a time,
+// e.g. by a second for a window of a minute, so that its memory does not grow with the number of events.
+const windowBuckets = 60
+
+// Windows holds the state of windowed aggregates such as (window_count user_id "1m"):
+// for every aggregate of every rule and every value of its key, the number and the sum of the values
+// of the events recorded in the window. It keeps at most maxKeys windows, forgetting the least recently
+// updated ones when it is full, and drops the windows of keys that had no event for their whole duration.
+// A Windows is safe for concurrent use.
+type Windows struct {
+	mu      sync.Mutex
+	maxKeys int
+	windows map[windowKey]*list.Element
+	lru     list.List // of *window, most recently updated first
+}
+
+type windowKey struct {
+	scope    string        // the scope of the program, see WithWindows
+	path     string        // the path of the aggregate in the expression of the program
+	duration time.Duration // so that changing the duration of an aggregate starts new windows
+	key      string
+}
+
+type window struct {
+	key     windowKey
+	width   int64 // the duration of a bucket, in milliseconds
+	buckets []bucket
+	last    int64 // the number of the bucket of the last event
+}
+
+type bucket struct {
+	n     int64 // the number of the bucket since the Unix epoch, when it was last used
+	count int
+	sum   float64
+}
+
+// NewWindows returns an empty store of windows that keeps at most maxKeys windows.
+func NewWindows(maxKeys int) *Windows {
+	return &Windows{maxKeys: maxKeys, windows: make(map[windowKey]*list.Element)}
+}
+
+// Len returns the number of windows in the store.
+func (ws *Windows) Len() int {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return len(ws.windows)
+}
+
+// add records an event with a value in the window of the key for the aggregate,
+// and returns the number and the sum of the values of the events in the window.
+func (ws *Windows) add(k windowKey, d time.Duration, now time.Time, value float64) (int, float64) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ms := now.UnixMilli()
+	var w *window
+	if e, ok := ws.windows[k]; ok {
+		w = e.Value.(*window)
+		ws.lru.MoveToFront(e)
+	} else {
+		w = newWindow(k, d)
+		ws.windows[k] = ws.lru.PushFront(w)
+	}
+	w.add(ms, value)
+	ws.expire(ms)
+	return w.total(ms)
+}
+
+// expire forgets the least recently updated windows that are idle, and those over maxKeys.
+func (ws *Windows) expire(ms int64) {
+	for e := ws.lru.Back(); e != nil && e != ws.lru.Front(); e = ws.lru.Back() {
+		w := e.Value.(*window)
+		if len(ws.windows) <= ws.maxKeys && !w.idle(ms) {
+			return
+		}
+		ws.lru.Remove(e)
+		delete(ws.windows, w.key)
+	}
+}
+
+func newWindow(k windowKey, d time.Duration) *window {
+	n := int64(windowBuckets)
+	if ms := d.Milliseconds(); ms < n {
+		n = max(ms, 1)
+	}
+	return &window{key: k, width: max(d.Milliseconds()/n, 1), buckets: make([]bucket, n)}
+}
+
+func (w *window) add(ms int64, value float64) {
+	n := ms / w.width
+	b := &w.buckets[n%int64(len(w.buckets))]
+	if b.n != n {
+		*b = bucket{n: n}
+	}
+	b.count++
+	b.sum += value
+	w.last = max(w.last, n)
+}
+
+func (w *window) total(ms int64) (int, float64) {
+	n := ms / w.width
+	count, sum := 0, 0.0
+	for _, b := range w.buckets {
+		if b.n > n-int64(len(w.buckets)) && b.n <= n {
+			count += b.count
+			sum += b.sum
+		}
+	}
+	return count, sum
+}
+
+func (w *window) idle(ms int64) bool {
+	return ms/w.width-w.last >= int64(len(w.buckets))
+}
+
+func isWindow(op string) bool {
+	return op == "window_count" || op == "window_sum"
+}
+
+// windowAggregate records the event in the window of an aggregate and returns its value:
+// the number of events with the same key in the window for window_count, and the sum of their values for window_sum.
+// args are the value for window_sum, then the key and the duration. It returns null when the key is null.
+func windowAggregate(ctx context.Context, cfg *optconfig, op, path string, args []interface{}) (interface{}, error) {
+	if cfg.windows == nil {
+		return nil, fmt.Errorf("%s needs windows to keep its state in, see WithWindows", op)
+	}
+	key := args[len(args)-2]
+	if key == nil {
+		return nil, nil
+	}
+	s, _ := args[len(args)-1].(string)
+	d, err := parseDuration(s)
+	if err != nil {
+		return nil, err
+	}
+	value := 0.0
+	if op == "window_sum" && args[0] != nil {
+		var ok bool
+		if value, ok = toFloat(cfg.coercion.number(args[0])); !ok {
+			return nil, fmt.Errorf("window_sum expects a number, got %T", args[0])
+		}
+	}
+	k := windowKey{scope: cfg.scope, path: path, duration: d, key: fmt.Sprint(key)}
+	count, sum := cfg.windows.add(k, d, Now(ctx), value)
+	if op == "window_count" {
+		return count, nil
+	}
+	return sum, nil
+}
+
+// checkWindow checks that the program has windows to keep the state of a windowed aggregate in,
+// and that its duration is a string literal holding a positive duration.
+func checkWindow(c *compiler, path string, args []Node) {
+	if !c.windows {
+		c.errorf(path, "windowed aggregates need windows to keep their state in, see WithWindows")
+	}
+	if len(args) < 2 {
+		return
+	}
+	i := len(args) - 1
+	argPath := fmt.Sprintf("%s[%d]", path, i+1)
+	s, ok := stringLiteral(args, i)
+	if !ok {
+		c.errorf(argPath, "expected a duration literal such as \"5m\"")
+		return
+	}
+	if d, err := parseDuration(s); err != nil {
+		c.errorf(argPath, "%v", err)
+	} else if d <= 0 {
+		c.errorf(argPath, "the duration of a window must be positive")
+	}
+}
+
+// exprPath returns the path of the call target in expr, e.g. $[2][1].
+func exprPath(expr Expression, target []interface{}, path string) (string, bool) {
+	e, ok := expr.([]interface{})
+	if !ok || len(e) == 0 || !isCall(e) {
+		return "", false
+	}
+	if &e[0] == &target[0] {
+		return path, true
+	}
+	for i, item := range e[1:] {
+		if p, ok := exprPath(item, target, fmt.Sprintf("%s[%d]", path, i+1)); ok {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// nodePaths records the path of every call in n, e.g. $[2][1].
+func nodePaths(n Node, path string, paths map[*Call]string) {
+	call, ok := n.(*Call)
+	if !ok {
+		return
+	}
+	paths[call] = path
+	for i, arg := range call.Args {
+		nodePaths(arg, fmt.Sprintf("%s[%d]", path, i+1), paths)
+	}
+}
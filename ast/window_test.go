@@ -0,0 +1,181 @@
+package ast
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWindowCount(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	clock := ClockFunc(func() time.Time { return now })
+	windows := NewWindows(100)
+	p, err := CompileString(`(and (== event "login_failed") (> (window_count user_id "1m") 5))`,
+		WithClock(clock), WithWindows(windows, "rule-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	login := func(user, event string) bool {
+		t.Helper()
+		ok, err := p.Evaluate(map[string]interface{}{"event": event, "user_id": user})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+
+	for i := 1; i <= 5; i++ {
+		if login("alice", "login_failed") {
+			t.Fatalf("matched after %d failed logins", i)
+		}
+		login("alice", "login") // not counted
+		if i%2 == 0 {
+			login("bob", "login_failed")
+		}
+		now = now.Add(5 * time.Second)
+	}
+	if !login("alice", "login_failed") {
+		t.Error("did not match the 6th failed login within a minute")
+	}
+	if login("bob", "login_failed") {
+		t.Error("matched the failed logins of another user")
+	}
+
+	// the first failed logins slide out of the window
+	now = now.Add(40 * time.Second)
+	if login("alice", "login_failed") {
+		t.Error("matched failed logins older than a minute")
+	}
+	now = now.Add(2 * time.Minute)
+	if login("alice", "login_failed") {
+		t.Error("matched after the window was idle")
+	}
+}
+
+func TestWindowSum(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	opts := []Option{WithClock(ClockFunc(func() time.Time { return now })), WithWindows(NewWindows(100), "rule-2")}
+	expr, err := ParseExpression(`(> (window_sum amount card_id "10m") 1000)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := Compile(expr, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		card   string
+		amount interface{}
+		wait   time.Duration
+		want   bool
+	}{
+		{"c1", "400", 0, false},
+		{"c1", 500.5, time.Minute, false},
+		{"c2", 900, time.Minute, false},
+		{"c1", nil, time.Minute, false},
+		{"c1", 100, 5 * time.Minute, true},
+		{"c1", 1, 5 * time.Minute, false}, // the first two are out of the window
+	}
+	for i, tt := range tests {
+		now = now.Add(tt.wait)
+		event := map[string]interface{}{"card_id": tt.card, "amount": tt.amount}
+		var got bool
+		// the interpreter and the program share the windows of the aggregate
+		if i%2 == 0 {
+			got, err = Evaluate(expr, event, opts...)
+		} else {
+			got, err = p.Evaluate(event)
+		}
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if got != tt.want {
+			t.Errorf("%d: expected %v, got %v", i, tt.want, got)
+		}
+	}
+	if _, err := p.Evaluate(map[string]interface{}{"card_id": "c1", "amount": "lots"}); err == nil {
+		t.Error("expected an error for an amount that is not a number")
+	}
+}
+
+func TestWindowsAreBounded(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	windows := NewWindows(3)
+	var programs []*Program
+	for _, scope := range []string{"a", "b"} {
+		p, err := CompileString(`(>= (window_count user_id "1m") 2)`,
+			WithClock(ClockFunc(func() time.Time { return now })), WithWindows(windows, scope))
+		if err != nil {
+			t.Fatal(err)
+		}
+		programs = append(programs, p)
+	}
+	if ok, _ := programs[0].Evaluate(map[string]interface{}{"user_id": "u1"}); ok {
+		t.Error("matched the first event")
+	}
+	if ok, _ := programs[1].Evaluate(map[string]interface{}{"user_id": "u1"}); ok {
+		t.Error("matched the first event of another scope")
+	}
+	for _, user := range []string{"u2", "u3", "u4"} {
+		programs[0].Evaluate(map[string]interface{}{"user_id": user})
+	}
+	if n := windows.Len(); n != 3 {
+		t.Errorf("expected 3 windows, got %d", n)
+	}
+	if ok, _ := programs[0].Evaluate(map[string]interface{}{"user_id": "u1"}); ok {
+		t.Error("matched a key whose window was forgotten")
+	}
+	now = now.Add(time.Hour)
+	programs[0].Evaluate(map[string]interface{}{"user_id": "u5"})
+	if n := windows.Len(); n != 1 {
+		t.Errorf("expected the idle windows to expire, got %d windows", n)
+	}
+	if ok, err := programs[0].Evaluate(map[string]interface{}{}); ok || err != nil {
+		t.Errorf("expected false for a missing key, got %v, %v", ok, err)
+	}
+}
+
+func TestWindowErrors(t *testing.T) {
+	for _, src := range []string{
+		`(> (window_count user_id window) 1)`,
+		`(> (window_count user_id "soon") 1)`,
+		`(> (window_count user_id "0s") 1)`,
+		`(window_count user_id "1m")`,
+		`(> (window_sum user_id "1m") 1)`,
+	} {
+		if _, err := CompileString(src, WithWindows(NewWindows(10), "r")); err == nil {
+			t.Errorf("%s: expected a compile error", src)
+		}
+	}
+	if _, err := CompileString(`(> (window_count user_id "1m") 1)`); err == nil {
+		t.Error("expected a compile error without windows")
+	}
+}
+
+func TestWindowDurationChange(t *testing.T) {
+	ws := NewWindows(10)
+	now := time.Unix(1700000000, 0)
+	clock := WithClock(ClockFunc(func() time.Time { return now }))
+	event := map[string]interface{}{"user_id": "u1"}
+	minute, err := CompileString(`(> (window_count user_id "1m") 2)`, WithWindows(ws, "r"), clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		minute.Evaluate(event)
+	}
+	// the rule is reloaded with a longer window: it counts from scratch rather than over the old one
+	hour, err := CompileString(`(> (window_count user_id "1h") 2)`, WithWindows(ws, "r"), clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		now = now.Add(2 * time.Minute)
+		if ok, err := hour.Evaluate(event); ok || err != nil {
+			t.Fatalf("event %d: got %v, %v, want false", i, ok, err)
+		}
+	}
+	now = now.Add(2 * time.Minute)
+	if ok, err := hour.Evaluate(event); !ok || err != nil {
+		t.Errorf("got %v, %v after 3 events within the hour", ok, err)
+	}
+}
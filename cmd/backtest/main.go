@@ -0,0 +1,161 @@
+// Command backtest replays recorded traffic through rules and reports what they would have matched, e.g.
+//
+//	go run ./cmd/backtest -rules rules.json -events payloads.jsonl.gz
+//
+// The rules file holds a JSON array of rules whose expressions are S expressions:
+//
+//	[{"id": "big_orders", "expression": "(> amount 1000)", "target": "fraud", "priority": 10}]
+//
+// A rule may be rolled out to a percentage of the events, chosen by a sample key, to see how a ramp up would behave:
+//
+//	{"id": "new_orders", "expression": "(== event \"order\")", "target": "orders", "rollout": 5, "sample_key": "user_id"}
+//
+// The events file holds JSON lines of payloads as sent to the data collection API, gzipped if it ends in .gz.
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/mntwo/tasklab/ast"
+	"github.com/mntwo/tasklab/rule"
+)
+
+var (
+	rulesFile  = flag.String("rules", "rules.json", "the rules to backtest, eg: -rules rules.json")
+	eventsFile = flag.String("events", "", "the recorded payloads, one JSON per line, eg: -events payloads.jsonl.gz")
+	samples    = flag.Int("samples", 5, "the number of matched events to show per rule")
+	asJSON     = flag.Bool("json", false, "print the report as JSON")
+	strategy   = flag.String("strategy", "all_match", "the rules that fire among those matching an event: all_match, first_match or top_tier")
+)
+
+type ruleConfig struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	Expression string   `json:"expression"`
+	Target     string   `json:"target"`
+	Priority   int      `json:"priority"`
+	Rollout    *float64 `json:"rollout"` // all events when omitted
+	SampleKey  string   `json:"sample_key"`
+}
+
+func main() {
+	flag.Parse()
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "backtest:", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	s, err := rule.ParseStrategy(*strategy)
+	if err != nil {
+		return err
+	}
+	rules, err := readRules(*rulesFile)
+	if err != nil {
+		return err
+	}
+	events, err := openEvents(*eventsFile)
+	if err != nil {
+		return err
+	}
+	defer events.Close()
+
+	report, err := rule.Backtest(context.Background(), rules, events, rule.WithSamples(*samples), rule.WithStrategy(s))
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	printReport(os.Stdout, report)
+	return nil
+}
+
+func readRules(name string) ([]rule.Rule, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var configs []ruleConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	rules := make([]rule.Rule, len(configs))
+	for i, c := range configs {
+		expr, err := ast.ParseExpression(c.Expression)
+		if err != nil {
+			return nil, fmt.Errorf("%s: rule %s: %w", name, c.ID, err)
+		}
+		rules[i] = rule.Rule{ID: c.ID, Name: c.Name, Expression: expr, Target: c.Target, Priority: c.Priority, Rollout: c.Rollout, SampleKey: c.SampleKey}
+	}
+	return rules, nil
+}
+
+type gzipFile struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (g gzipFile) Close() error {
+	g.Reader.Close()
+	return g.f.Close()
+}
+
+func openEvents(name string) (io.ReadCloser, error) {
+	if name == "" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(name, ".gz") {
+		return f, nil
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return gzipFile{Reader: zr, f: f}, nil
+}
+
+func printReport(w io.Writer, report *rule.BacktestReport) {
+	fmt.Fprintf(w, "%d events, %d matched\n", report.Events, report.Matched)
+	for _, r := range report.Rules {
+		fmt.Fprintf(w, "\nrule %s", r.ID)
+		if r.Name != "" {
+			fmt.Fprintf(w, " (%s)", r.Name)
+		}
+		fmt.Fprintf(w, " -> %s: %d matched", r.Target, r.Matched)
+		if report.Events > 0 {
+			fmt.Fprintf(w, " (%.2f%%)", 100*float64(r.Matched)/float64(report.Events))
+		}
+		fmt.Fprintf(w, ", %d fired\n", r.Fired)
+		if r.Errors > 0 {
+			fmt.Fprintf(w, "  %d errors, first: %s\n", r.Errors, r.Error)
+		}
+		for _, sample := range r.Samples {
+			data, _ := json.Marshal(sample)
+			fmt.Fprintf(w, "  %s\n", data)
+		}
+	}
+	fmt.Fprintln(w, "\ntargets:")
+	printed := make(map[string]bool)
+	for _, r := range report.Rules {
+		if n, ok := report.Targets[r.Target]; ok && !printed[r.Target] {
+			printed[r.Target] = true
+			fmt.Fprintf(w, "  %s: %d events\n", r.Target, n)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/mntwo/tasklab/data_collection/api/data_report_api"
 	"github.com/mntwo/tasklab/data_collection/api/health_check_api"
+	"github.com/mntwo/tasklab/data_collection/api/rule_api"
 )
 
 func Handler(route *gin.Engine) {
@@ -11,5 +12,6 @@ func Handler(route *gin.Engine) {
 	v1 := route.Group("/v1")
 	{
 		v1.POST("/report", data_report_api.Collect)
+		v1.POST("/rule/test", rule_api.Test)
 	}
 }
@@ -0,0 +1,135 @@
+package rule_api
+
+import (
+	stdjson "encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mntwo/tasklab/ast"
+	"github.com/mntwo/tasklab/encoding"
+	"github.com/mntwo/tasklab/encoding/json"
+	"github.com/mntwo/tasklab/internal/log"
+	"github.com/mntwo/tasklab/rule"
+	"go.uber.org/zap"
+)
+
+// testRequest is an expression to test against a sample payload, or else against an event and its properties.
+type testRequest struct {
+	Expression string             `json:"expression"`
+	Syntax     string             `json:"syntax"` // sexpr, the default, infix or json
+	Payload    stdjson.RawMessage `json:"payload"`
+	Event      string             `json:"event"`
+	Properties map[string]string  `json:"properties"`
+}
+
+type testResponse struct {
+	Valid  bool       `json:"valid"`
+	Parsed string     `json:"parsed,omitempty"` // the expression as an S expression
+	Errors []*problem `json:"errors,omitempty"` // the syntax, limit and validation errors of the expression
+	Result bool       `json:"result"`
+	Error  string     `json:"error,omitempty"` // the error of the evaluation
+	Trace  *ast.Trace `json:"trace,omitempty"`
+}
+
+type problem struct {
+	Path   string `json:"path,omitempty"`
+	Line   int    `json:"line,omitempty"`
+	Column int    `json:"column,omitempty"`
+	Msg    string `json:"msg"`
+}
+
+// Test parses and compiles an expression, and evaluates it against a sample payload with an explanation,
+// so that rules can be validated without deploying them. The expression is compiled as the rules are,
+// with the options of the rule engine, e.g. its library of predicates.
+func Test(c *gin.Context) {
+	var (
+		ctx = c.Request.Context()
+		req testRequest
+	)
+	if err := c.ShouldBindJSON(&req); err != nil {
+		log.Error(ctx, "unmarshal body failed", zap.Error(err))
+		c.JSON(http.StatusBadRequest, gin.H{"code": 2, "msg": "unmarshal body failed"})
+		return
+	}
+	payload, err := samplePayload(req)
+	if err != nil {
+		log.Error(ctx, "unmarshal payload failed", zap.Error(err), zap.ByteString("payload", req.Payload))
+		c.JSON(http.StatusBadRequest, gin.H{"code": 2, "msg": "unmarshal payload failed"})
+		return
+	}
+
+	var (
+		resp testResponse
+		p    *ast.Program
+		// windowed aggregates record the event in windows of the request, rather than in those of the rules
+		opts = append(rule.ASTOptions(), ast.WithWindows(ast.NewWindows(100), "test"))
+	)
+	switch req.Syntax {
+	case "", "sexpr":
+		p, err = ast.CompileString(req.Expression, opts...)
+	case "infix":
+		p, err = ast.CompileInfix(req.Expression, opts...)
+	case "json":
+		p, err = ast.CompileJSON([]byte(req.Expression), opts...)
+	default:
+		log.Error(ctx, "unknown syntax", zap.String("syntax", req.Syntax))
+		c.JSON(http.StatusBadRequest, gin.H{"code": 4, "msg": "unknown syntax " + req.Syntax})
+		return
+	}
+	if err != nil {
+		resp.Errors = problems(err)
+		c.JSON(http.StatusOK, gin.H{"code": 0, "msg": "ok", "data": resp})
+		return
+	}
+	resp.Valid = true
+	resp.Parsed, _ = ast.FormatSExpr(p.Expression())
+
+	// the explanation stops when the client goes away, since the expression may be expensive
+	resp.Trace, err = p.ExplainContext(ctx, ast.FromPayload(payload))
+	if err != nil {
+		resp.Error = err.Error()
+	} else {
+		resp.Result, _ = resp.Trace.Result.(bool)
+	}
+	c.JSON(http.StatusOK, gin.H{"code": 0, "msg": "ok", "data": resp})
+}
+
+func samplePayload(req testRequest) (encoding.Payload, error) {
+	data := []byte(req.Payload)
+	if len(data) == 0 {
+		var err error
+		data, err = stdjson.Marshal(gin.H{"event": req.Event, "properties": req.Properties})
+		if err != nil {
+			return nil, err
+		}
+	}
+	p := json.New()
+	return p, p.Unmarshal(data)
+}
+
+// problems lists the errors of compiling an expression.
+func problems(err error) []*problem {
+	var (
+		compileErrs ast.CompileErrors
+		syntaxErr   *ast.SyntaxError
+		limitErr    *ast.LimitError
+	)
+	switch {
+	case errors.As(err, &compileErrs):
+		ps := make([]*problem, len(compileErrs))
+		for i, e := range compileErrs {
+			ps[i] = &problem{Path: e.Path, Line: e.Pos.Line, Column: e.Pos.Col, Msg: e.Msg}
+		}
+		return ps
+	case errors.As(err, &syntaxErr):
+		msg := strings.TrimPrefix(syntaxErr.Error(), syntaxErr.Pos.String()+": ")
+		return []*problem{{Line: syntaxErr.Pos.Line, Column: syntaxErr.Pos.Col, Msg: msg}}
+	case errors.As(err, &limitErr):
+		msg := fmt.Sprintf("expression exceeds the maximum %s of %d", limitErr.Limit, limitErr.Max)
+		return []*problem{{Path: limitErr.Path, Line: limitErr.Pos.Line, Column: limitErr.Pos.Col, Msg: msg}}
+	}
+	return []*problem{{Msg: err.Error()}}
+}
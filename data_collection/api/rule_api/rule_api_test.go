@@ -0,0 +1,128 @@
+package rule_api
+
+import (
+	stdjson "encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mntwo/tasklab/ast"
+	"github.com/mntwo/tasklab/rule"
+)
+
+type testResult struct {
+	Code int          `json:"code"`
+	Msg  string       `json:"msg"`
+	Data testResponse `json:"data"`
+}
+
+func post(t *testing.T, body interface{}) (int, testResult) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	route := gin.New()
+	route.POST("/v1/rule/test", Test)
+	data, err := stdjson.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	route.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/rule/test", strings.NewReader(string(data))))
+	var result testResult
+	if err := stdjson.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("%s: %v", w.Body, err)
+	}
+	return w.Code, result
+}
+
+func TestTrace(t *testing.T) {
+	code, result := post(t, gin.H{
+		"expression": `(and (== event "order") (> amount 100))`,
+		"payload":    gin.H{"event": "order", "properties": gin.H{"amount": "500"}},
+	})
+	if code != http.StatusOK || !result.Data.Valid || !result.Data.Result {
+		t.Fatalf("got %d %+v", code, result)
+	}
+	if result.Data.Parsed != `(and (== event "order") (> amount 100))` {
+		t.Errorf("parsed %q", result.Data.Parsed)
+	}
+	trace := result.Data.Trace
+	if trace == nil || len(trace.Children) != 2 || trace.Children[1].Expr != "(> amount 100)" {
+		t.Errorf("got trace %+v", trace)
+	}
+
+	_, result = post(t, gin.H{
+		"expression": `amount > 1000`,
+		"syntax":     "infix",
+		"event":      "order",
+		"properties": gin.H{"amount": "500"},
+	})
+	if !result.Data.Valid || result.Data.Result || result.Data.Trace == nil {
+		t.Errorf("infix: got %+v", result)
+	}
+}
+
+func TestSyntaxError(t *testing.T) {
+	_, result := post(t, gin.H{"expression": "(and\n  (== a 1)\n  (> b 2)"})
+	errs := result.Data.Errors
+	if result.Data.Valid || len(errs) != 1 || errs[0].Line == 0 || errs[0].Column == 0 || errs[0].Msg == "" {
+		t.Fatalf("got %+v", result)
+	}
+	if strings.HasPrefix(errs[0].Msg, "3:") {
+		t.Errorf("message %q repeats the position", errs[0].Msg)
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	_, result := post(t, gin.H{"expression": `(and (> amount) (unknown_fn a))`})
+	errs := result.Data.Errors
+	if result.Data.Valid || len(errs) != 2 {
+		t.Fatalf("got %+v", result)
+	}
+	if errs[0].Path != "$[1]" || errs[1].Path != "$[2]" || errs[0].Line != 1 || errs[1].Column == 0 {
+		t.Errorf("got errors %+v, %+v", errs[0], errs[1])
+	}
+}
+
+func TestLimitError(t *testing.T) {
+	expr := strings.Repeat("(not ", 200) + `(== a 1)` + strings.Repeat(")", 200)
+	_, result := post(t, gin.H{"expression": expr})
+	errs := result.Data.Errors
+	if result.Data.Valid || len(errs) != 1 || !strings.Contains(errs[0].Msg, "exceeds the maximum depth") || errs[0].Path == "" {
+		t.Fatalf("got %+v", result)
+	}
+}
+
+func TestBadRequest(t *testing.T) {
+	code, result := post(t, gin.H{"expression": `(== a 1)`, "syntax": "yaml"})
+	if code != http.StatusBadRequest || result.Code != 4 || result.Msg != "unknown syntax yaml" {
+		t.Errorf("unknown syntax: got %d %+v", code, result)
+	}
+	code, result = post(t, gin.H{"expression": `(== a 1)`, "payload": "not a payload"})
+	if code != http.StatusBadRequest || result.Code != 2 {
+		t.Errorf("invalid payload: got %d %+v", code, result)
+	}
+}
+
+func TestEngineOptions(t *testing.T) {
+	library := ast.NewLibrary()
+	if err := library.Define("is_paying", mustParse(t, `(== plan "paid")`)); err != nil {
+		t.Fatal(err)
+	}
+	rule.Configure(rule.WithASTOptions(ast.WithLibrary(library)))
+	defer rule.Configure()
+	_, result := post(t, gin.H{"expression": `(ref is_paying)`, "event": "order", "properties": gin.H{"plan": "paid"}})
+	if !result.Data.Valid || !result.Data.Result {
+		t.Errorf("got %+v", result)
+	}
+}
+
+func mustParse(t *testing.T, s string) ast.Expression {
+	t.Helper()
+	expr, err := ast.ParseExpression(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return expr
+}
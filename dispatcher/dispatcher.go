@@ -6,17 +6,51 @@ import (
 
 	"github.com/mntwo/tasklab/encoding"
 	"github.com/mntwo/tasklab/event_manager"
+	"github.com/mntwo/tasklab/internal/log"
+	"github.com/mntwo/tasklab/rule"
+	"go.uber.org/zap"
 )
 
 var (
 	ErrEventManagerNotFound = errors.New("event manager not found")
 )
 
+// Dispatch routes a payload to the targets of the rules matching it that fire, according to the strategy of its event.
+// Without enabled rules, it is routed to the event manager named after its event.
+// It returns an error if the target of a rule, or the event manager, is not found;
+// the other errors of rules are logged, and the payload is delivered to the targets of the other rules.
 func Dispatch(ctx context.Context, payload encoding.Payload) error {
-	m, ok := event_manager.GetEventManager(payload.GetEvent())
-	if !ok {
-		return ErrEventManagerNotFound
+	routing, err := rule.Dispatch(ctx, payload)
+	if errors.Is(err, rule.ErrNoRules) {
+		m, ok := event_manager.GetEventManager(payload.GetEvent())
+		if !ok {
+			return ErrEventManagerNotFound
+		}
+		m.Notify(payload.GetProperties())
+		return nil
+	}
+	if err != nil {
+		log.Warn(ctx, "rule dispatch failed", zap.Error(err), zap.String("event", payload.GetEvent()))
+	}
+	log.Debug(ctx, "rules matched",
+		zap.String("event", payload.GetEvent()),
+		zap.Stringer("strategy", routing.Strategy),
+		zap.Strings("matched", ruleIDs(routing.Matched)),
+		zap.Strings("fired", ruleIDs(routing.Fired)),
+		// why every rule that may match the event did or did not, when the rules are traced
+		zap.Any("traces", routing.Traces),
+	)
+	if errors.Is(err, rule.ErrTargetNotFound) {
+		// reported like a missing event manager, since the event is not delivered where a rule says
+		return err
 	}
-	m.Notify(payload.GetProperties())
 	return nil
 }
+
+func ruleIDs(rules []rule.Rule) []string {
+	ids := make([]string, len(rules))
+	for i, r := range rules {
+		ids[i] = r.ID
+	}
+	return ids
+}
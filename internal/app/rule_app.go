@@ -0,0 +1,10 @@
+package app
+
+import (
+	"github.com/mntwo/tasklab/internal/application"
+	"github.com/mntwo/tasklab/internal/application/rule_application"
+)
+
+func NewRuleApp() application.Application {
+	return rule_application.New("rule_app")
+}
@@ -0,0 +1,97 @@
+package rule_application
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/mntwo/tasklab/internal/application"
+	"github.com/mntwo/tasklab/internal/config"
+	"github.com/mntwo/tasklab/internal/db"
+	"github.com/mntwo/tasklab/internal/log"
+	"github.com/mntwo/tasklab/rule"
+	"github.com/mntwo/tasklab/rule/postgres_store"
+	"go.uber.org/zap"
+)
+
+var _ application.Application = (*RuleApplication)(nil)
+
+const defaultReloadInterval = 5 * time.Second
+
+// RuleApplication loads the active rules from the database into the rule engine once the database is connected,
+// and reloads them whenever they change.
+// The rule engine is configured from the config and the options, e.g. rule.WithASTOptions(ast.WithLibrary(library)).
+type RuleApplication struct {
+	Name   string
+	opts   []rule.Option
+	stopCh chan struct{}
+}
+
+func New(name string, opts ...rule.Option) *RuleApplication {
+	return &RuleApplication{
+		Name:   name,
+		opts:   opts,
+		stopCh: make(chan struct{}),
+	}
+}
+
+func (a *RuleApplication) Start() error {
+	if c := config.GetRule(); c != nil {
+		var opts []rule.Option
+		if c.MaxWindowKeys > 0 {
+			opts = append(opts, rule.WithMaxWindowKeys(c.MaxWindowKeys))
+		}
+		if c.Trace {
+			opts = append(opts, rule.WithTraces())
+		}
+		for event, name := range c.Strategies {
+			s, err := rule.ParseStrategy(name)
+			if err != nil {
+				return fmt.Errorf("rule strategy of %s: %w", event, err)
+			}
+			opts = append(opts, rule.WithEventStrategy(event, s))
+		}
+		rule.Configure(append(opts, a.opts...)...)
+		select {
+		case <-db.Ready():
+		case <-a.stopCh:
+			return application.ErrApplicationClosed
+		}
+		gdb := db.GetDB(c.DB)
+		if gdb == nil {
+			return fmt.Errorf("rule database %s not found", c.DB)
+		}
+		ctx := context.Background()
+		store := postgres_store.New(gdb)
+		if err := store.Migrate(ctx); err != nil {
+			return err
+		}
+		// the rules that do not compile are reported, and the others are loaded
+		if err := rule.Load(ctx, store); err != nil {
+			log.Error(ctx, "load rules failed", zap.Error(err))
+		}
+		log.Info(ctx, "rules loaded", zap.Int("rules", rule.Len()))
+
+		interval := c.ReloadInterval
+		if interval <= 0 {
+			interval = defaultReloadInterval
+		}
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go rule.Watch(ctx, store, interval, func(err error) {
+			log.Error(ctx, "reload rules failed", zap.Error(err))
+		})
+	}
+	<-a.stopCh
+	return application.ErrApplicationClosed
+}
+
+func (a *RuleApplication) Stop() error {
+	close(a.stopCh)
+	rule.CloseHandlers()
+	return nil
+}
+
+func (a *RuleApplication) GetName() string {
+	return a.Name
+}
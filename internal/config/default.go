@@ -2,6 +2,7 @@ package config
 
 import (
 	"flag"
+	"testing"
 	"time"
 
 	"github.com/mntwo/tasklab/internal/configer/yaml_config"
@@ -11,6 +12,10 @@ var defaultConfig *Config
 var configFile = flag.String("i", "config.yaml", "the application config file, eg: -i config.yaml, default: config.yaml")
 
 func init() {
+	// tests have neither the flags nor the config file of the application, and get the defaults of every config
+	if testing.Testing() {
+		return
+	}
 	flag.Parse()
 	defaultConfig = New()
 }
@@ -68,11 +73,19 @@ func GetPostgres() []*Postgres {
 	return defaultConfig.Postgres
 }
 
+func GetRule() *Rule {
+	if defaultConfig == nil {
+		return nil
+	}
+	return defaultConfig.Rule
+}
+
 type Config struct {
 	Application *Application  `json:"application" yaml:"application"`
 	HttpServer  []*HttpServer `json:"http_server" yaml:"http_server"`
 	Log         *Log          `json:"log" yaml:"log"`
 	Postgres    []*Postgres   `json:"postgres" yaml:"postgres"`
+	Rule        *Rule         `json:"rule" yaml:"rule"`
 }
 
 type Application struct {
@@ -112,3 +125,11 @@ type Postgres struct {
 	ConnMaxLifetime time.Duration `json:"conn_max_lifetime" yaml:"conn_max_lifetime"`
 	ConnMaxIdleTime time.Duration `json:"conn_max_idle_time" yaml:"conn_max_idle_time"`
 }
+
+type Rule struct {
+	DB             string            `json:"db" yaml:"db"`                           // the name of the postgres database the rules are stored in
+	ReloadInterval time.Duration     `json:"reload_interval" yaml:"reload_interval"` // how often the rules are checked for changes, 5s by default
+	Strategies     map[string]string `json:"strategies" yaml:"strategies"`           // the match strategy of events by name, all_match by default
+	MaxWindowKeys  int               `json:"max_window_keys" yaml:"max_window_keys"` // the maximum number of windows of windowed aggregates, 100000 by default
+	Trace          bool              `json:"trace" yaml:"trace"`                     // whether to log the traces of the rules evaluated for every event, at debug level
+}
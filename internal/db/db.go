@@ -56,6 +56,7 @@ func (d *db) Start() error {
 		}
 		dbs[dbConfig.Name] = db
 	}
+	close(ready)
 	<-d.stopCh
 	return application.ErrApplicationClosed
 }
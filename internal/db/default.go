@@ -4,6 +4,14 @@ import "gorm.io/gorm"
 
 var dbs map[string]*gorm.DB
 
+// ready is closed once the databases are connected.
+var ready = make(chan struct{})
+
 func GetDB(dbName string) *gorm.DB {
 	return dbs[dbName]
 }
+
+// Ready returns a channel that is closed once the databases are connected and GetDB can be called.
+func Ready() <-chan struct{} {
+	return ready
+}
@@ -9,5 +9,6 @@ func main() {
 	db := app.NewDatabaseApp()
 	dataCollectApp := app.NewDataCollectionApp()
 	genEventApp := app.NewGenEventApp()
-	app.Run(db, dataCollectApp, genEventApp)
+	ruleApp := app.NewRuleApp()
+	app.Run(db, ruleApp, dataCollectApp, genEventApp)
 }
@@ -0,0 +1,175 @@
+package rule
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/mntwo/tasklab/ast"
+	"github.com/mntwo/tasklab/encoding"
+)
+
+// Op is the operation of an action.
+type Op string
+
+const (
+	OpSet     Op = "set"     // sets Field to Value
+	OpRename  Op = "rename"  // renames Field to To
+	OpDrop    Op = "drop"    // drops Field
+	OpCopy    Op = "copy"    // copies Field to To
+	OpCompute Op = "compute" // sets Field to the value of Expression, see ast.CompileValue
+	OpMask    Op = "mask"    // replaces the characters of Field by *, except the last Keep ones
+)
+
+// Action transforms the properties of the events a rule delivers to its target.
+// The actions of a rule are applied in order, each seeing the properties left by the previous ones.
+// Renaming, copying or masking a missing property does nothing.
+type Action struct {
+	Op         Op
+	Field      string
+	To         string         // the property that rename and copy write to
+	Value      string         // the value that set writes
+	Expression ast.Expression // the value that compute writes, evaluated against the properties with ts, event and project
+	Keep       int            // the number of characters that mask leaves visible at the end
+}
+
+// actionJSON is how actions are stored, with their expression as an S expression.
+type actionJSON struct {
+	Op         Op     `json:"op"`
+	Field      string `json:"field"`
+	To         string `json:"to,omitempty"`
+	Value      string `json:"value,omitempty"`
+	Expression string `json:"expression,omitempty"`
+	Keep       int    `json:"keep,omitempty"`
+}
+
+func (a Action) MarshalJSON() ([]byte, error) {
+	j := actionJSON{Op: a.Op, Field: a.Field, To: a.To, Value: a.Value, Keep: a.Keep}
+	if a.Expression != nil {
+		s, err := ast.FormatSExpr(a.Expression)
+		if err != nil {
+			return nil, err
+		}
+		j.Expression = s
+	}
+	return json.Marshal(j)
+}
+
+func (a *Action) UnmarshalJSON(data []byte) error {
+	var j actionJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	*a = Action{Op: j.Op, Field: j.Field, To: j.To, Value: j.Value, Keep: j.Keep}
+	if j.Expression != "" {
+		expr, err := ast.ParseExpression(j.Expression)
+		if err != nil {
+			return fmt.Errorf("action %s %s: %w", j.Op, j.Field, err)
+		}
+		a.Expression = expr
+	}
+	return nil
+}
+
+// compiledAction is an action whose expression, if any, is compiled.
+type compiledAction struct {
+	Action
+	value *ast.Value
+}
+
+func compileAction(a Action, opts []ast.Option) (compiledAction, error) {
+	if a.Field == "" {
+		return compiledAction{}, fmt.Errorf("%s has no field", a.Op)
+	}
+	c := compiledAction{Action: a}
+	switch a.Op {
+	case OpSet, OpDrop:
+	case OpRename, OpCopy:
+		if a.To == "" {
+			return c, fmt.Errorf("%s %s has no destination", a.Op, a.Field)
+		}
+	case OpCompute:
+		if a.Expression == nil {
+			return c, fmt.Errorf("compute %s has no expression", a.Field)
+		}
+		v, err := ast.CompileValue(a.Expression, opts...)
+		if err != nil {
+			return c, fmt.Errorf("compute %s: %w", a.Field, err)
+		}
+		c.value = v
+	case OpMask:
+		if a.Keep < 0 {
+			return c, fmt.Errorf("mask %s keeps %d characters", a.Field, a.Keep)
+		}
+	default:
+		return c, fmt.Errorf("unknown action %q", a.Op)
+	}
+	return c, nil
+}
+
+// transform returns the properties of the payload transformed by the actions, leaving the payload unchanged.
+func transform(ctx context.Context, actions []compiledAction, payload encoding.Payload) (map[string]string, error) {
+	properties := payload.GetProperties()
+	if len(actions) == 0 {
+		return properties, nil
+	}
+	props := make(map[string]string, len(properties))
+	for k, v := range properties {
+		props[k] = v
+	}
+	for i, a := range actions {
+		v, ok := props[a.Field]
+		switch a.Op {
+		case OpSet:
+			props[a.Field] = a.Value
+		case OpRename:
+			if ok {
+				delete(props, a.Field)
+				props[a.To] = v
+			}
+		case OpDrop:
+			delete(props, a.Field)
+		case OpCopy:
+			if ok {
+				props[a.To] = v
+			}
+		case OpCompute:
+			result, err := a.value.EvaluateContext(ctx, ast.FromPayloadProperties(payload, props))
+			if err != nil {
+				return nil, fmt.Errorf("action %d, compute %s: %w", i, a.Field, err)
+			}
+			if result == nil {
+				delete(props, a.Field)
+			} else {
+				props[a.Field] = fmt.Sprint(result)
+			}
+		case OpMask:
+			if ok {
+				props[a.Field] = mask(v, a.Keep)
+			}
+		}
+	}
+	return props, nil
+}
+
+// mask replaces the characters of s by *, except the last keep ones.
+func mask(s string, keep int) string {
+	r := []rune(s)
+	if keep >= len(r) {
+		return s
+	}
+	return strings.Repeat("*", len(r)-keep) + string(r[len(r)-keep:])
+}
+
+// formatActions formats actions as JSON, as they are stored.
+func formatActions(actions []Action) string {
+	if len(actions) == 0 {
+		return "[]"
+	}
+	data, err := json.Marshal(actions)
+	if err != nil {
+		return fmt.Sprint(actions)
+	}
+	return string(data)
+}
@@ -0,0 +1,89 @@
+package rule
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestDispatchActions(t *testing.T) {
+	cards := &recorder{}
+	RegisterHandler("test_cards", cards)
+
+	e := NewEngine()
+	err := e.Add(Rule{
+		ID:         "cards",
+		Expression: mustParse(t, `(== event "payment")`),
+		Target:     "test_cards",
+		Enabled:    true,
+		Actions: []Action{
+			{Op: OpSet, Field: "source", Value: "web"},
+			{Op: OpRename, Field: "amt", To: "amount"},
+			{Op: OpCopy, Field: "user", To: "customer"},
+			{Op: OpDrop, Field: "cvv"},
+			{Op: OpCompute, Field: "total", Expression: mustParse(t, `(* amount qty)`)},
+			{Op: OpCompute, Field: "kind", Expression: mustParse(t, `(upper event)`)},
+			{Op: OpMask, Field: "card", Keep: 4},
+			{Op: OpMask, Field: "missing", Keep: 4},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := payload(t, `{"event": "payment", "properties": {"amt": "2.5", "qty": "3", "user": "a", "cvv": "123", "card": "4111111111111111"}}`)
+	if _, err := e.Dispatch(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"source": "web", "amount": "2.5", "qty": "3", "user": "a", "customer": "a",
+		"total": "7.5", "kind": "PAYMENT", "card": "************1111",
+	}
+	waitCounts(t, "payment", []*recorder{cards}, 1)
+	if !reflect.DeepEqual(cards.events[0], want) {
+		t.Errorf("delivered %v, want %v", cards.events, want)
+	}
+	if _, ok := p.GetProperties()["cvv"]; !ok {
+		t.Error("actions changed the properties of the payload")
+	}
+}
+
+func TestCompileActions(t *testing.T) {
+	invalid := [][]Action{
+		{{Op: OpSet}},
+		{{Op: OpRename, Field: "a"}},
+		{{Op: OpCompute, Field: "a"}},
+		{{Op: OpCompute, Field: "a", Expression: mustParse(t, `(and a b)`)}},
+		{{Op: OpMask, Field: "a", Keep: -1}},
+		{{Op: "upper", Field: "a"}},
+		{{Op: OpCompute, Field: "a", Expression: mustParse(t, `(+ 1 (window_count user "1m"))`)}},
+	}
+	e := NewEngine()
+	for _, actions := range invalid {
+		if err := e.Add(Rule{ID: "r", Expression: mustParse(t, `(== event "a")`), Actions: actions}); err == nil {
+			t.Errorf("added a rule with actions %v", actions)
+		}
+	}
+}
+
+func TestActionJSON(t *testing.T) {
+	actions := []Action{
+		{Op: OpCompute, Field: "total", Expression: mustParse(t, `(* amount qty)`)},
+		{Op: OpMask, Field: "card", Keep: 4},
+	}
+	data, err := json.Marshal(actions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[{"op":"compute","field":"total","expression":"(* amount qty)"},{"op":"mask","field":"card","keep":4}]`
+	if string(data) != want {
+		t.Errorf("got %s, want %s", data, want)
+	}
+	var decoded []Action
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, actions) {
+		t.Errorf("decoded %v, want %v", decoded, actions)
+	}
+}
@@ -0,0 +1,114 @@
+package rule
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/mntwo/tasklab/ast"
+	"github.com/mntwo/tasklab/encoding/json"
+)
+
+// maxPayloadSize is the maximum size of a line of recorded traffic.
+const maxPayloadSize = 16 << 20
+
+// BacktestReport reports how rules would have routed recorded traffic.
+type BacktestReport struct {
+	Events  int            `json:"events"`  // the number of events replayed
+	Matched int            `json:"matched"` // the number of events matched by at least one rule
+	Rules   []*RuleReport  `json:"rules"`   // by decreasing priority
+	Targets map[string]int `json:"targets"` // the number of events every target would have received
+}
+
+// RuleReport reports how a rule would have matched recorded traffic.
+type RuleReport struct {
+	ID      string                   `json:"id"`
+	Name    string                   `json:"name"`
+	Target  string                   `json:"target"`
+	Matched int                      `json:"matched"`
+	Fired   int                      `json:"fired"`             // the number of events the rule fired for, according to the strategy
+	Errors  int                      `json:"errors"`            // the number of events the rule failed to evaluate
+	Error   string                   `json:"error,omitempty"`   // the first of these errors
+	Samples []map[string]interface{} `json:"samples,omitempty"` // the first events matched, see WithSamples
+}
+
+// Backtest replays recorded traffic through rules, whether enabled or not, and reports which events they match
+// and which targets the events would have been delivered to, without delivering them.
+// The traffic is read as JSON lines of payloads, as they are sent to the data collection API.
+// Events are evaluated at the time of their ts, so that time functions and windowed aggregates behave as they did live,
+// and the rules that fire are decided by the strategy given WithStrategy.
+func Backtest(ctx context.Context, rules []Rule, traffic io.Reader, opts ...Option) (*BacktestReport, error) {
+	var now time.Time
+	clock := ast.ClockFunc(func() time.Time { return now })
+	opts = append(opts, WithASTOptions(ast.WithClock(clock)))
+	e := NewEngine(opts...)
+	enabled := make([]Rule, len(rules))
+	for i, r := range rules {
+		r.Enabled = true
+		enabled[i] = r
+	}
+	if err := e.Set(enabled); err != nil {
+		return nil, err
+	}
+
+	report := &BacktestReport{Targets: make(map[string]int)}
+	reports := make(map[string]*RuleReport, len(rules))
+	for _, r := range e.Rules() {
+		rr := &RuleReport{ID: r.ID, Name: r.Name, Target: r.Target}
+		reports[r.ID] = rr
+		report.Rules = append(report.Rules, rr)
+	}
+
+	t := e.table.Load()
+	scanner := bufio.NewScanner(traffic)
+	scanner.Buffer(nil, maxPayloadSize)
+	for line := 1; scanner.Scan(); line++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		p := json.New()
+		if err := p.Unmarshal(data); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		now = time.Now()
+		if ts := p.GetTs(); ts > 0 {
+			now = time.UnixMilli(ts)
+		}
+		event := ast.FromPayload(p)
+		report.Events++
+		routing := t.route(ctx, p.GetEvent(), event, func(r Rule, err error) {
+			rr := reports[r.ID]
+			if rr.Errors == 0 {
+				rr.Error = err.Error()
+			}
+			rr.Errors++
+		})
+		if len(routing.Matched) > 0 {
+			report.Matched++
+		}
+		for _, r := range routing.Matched {
+			rr := reports[r.ID]
+			rr.Matched++
+			if len(rr.Samples) < e.cfg.samples {
+				rr.Samples = append(rr.Samples, event)
+			}
+		}
+		for _, r := range routing.Fired {
+			reports[r.ID].Fired++
+		}
+		for _, r := range deliveries(routing.Fired) {
+			report.Targets[r.Target]++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
@@ -0,0 +1,48 @@
+package rule
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestBacktest(t *testing.T) {
+	rules := []Rule{
+		{ID: "big", Expression: mustParse(t, `(and (== event "order") (> amount 1000))`), Target: "fraud", Priority: 10},
+		{ID: "orders", Expression: mustParse(t, `(== event "order")`), Target: "orders"},
+		{ID: "bursts", Expression: mustParse(t, `(> (window_count user "1m") 2)`), Target: "fraud"},
+		{ID: "fails", Expression: mustParse(t, `(> (/ amount 0) 1)`), Target: "orders"},
+	}
+	traffic := `{"event": "order", "properties": {"amount": "50", "user": "a"}, "ts": 1700000000000}
+{"event": "order", "properties": {"amount": "5000", "user": "a"}, "ts": 1700000001000}
+
+{"event": "signup", "properties": {"user": "a"}, "ts": 1700000002000}
+{"event": "signup", "properties": {"user": "a"}, "ts": 1700000200000}
+`
+	report, err := Backtest(context.Background(), rules, strings.NewReader(traffic), WithSamples(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Events != 4 || report.Matched != 3 {
+		t.Errorf("%d events, %d matched, want 4, 3", report.Events, report.Matched)
+	}
+	want := map[string]int{"big": 1, "bursts": 1, "fails": 0, "orders": 2}
+	for _, r := range report.Rules {
+		if r.Matched != want[r.ID] {
+			t.Errorf("rule %s matched %d events, want %d", r.ID, r.Matched, want[r.ID])
+		}
+		if len(r.Samples) > 1 {
+			t.Errorf("rule %s has %d samples, want at most 1", r.ID, len(r.Samples))
+		}
+	}
+	if fails := report.Rules[2]; fails.ID != "fails" || fails.Errors != 2 || fails.Error == "" {
+		t.Errorf("got report %+v for the rule failing on orders", fails)
+	}
+	if report.Targets["fraud"] != 2 || report.Targets["orders"] != 2 {
+		t.Errorf("targets %v, want 2 events for fraud and orders", report.Targets)
+	}
+
+	if _, err := Backtest(context.Background(), rules, strings.NewReader("{\n")); err == nil || !strings.HasPrefix(err.Error(), "line 1: ") {
+		t.Errorf("invalid traffic: got %v", err)
+	}
+}
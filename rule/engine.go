@@ -0,0 +1,404 @@
+package rule
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mntwo/tasklab/ast"
+	"github.com/mntwo/tasklab/encoding"
+)
+
+// engine is the default engine, which the functions of the package use, see Configure.
+var engine atomic.Pointer[Engine]
+
+func init() {
+	engine.Store(NewEngine())
+}
+
+// Configure replaces the default engine, which the functions of the package and the dispatcher use,
+// by an engine without rules built with the options, e.g. WithASTOptions(ast.WithLibrary(library)).
+// It is meant to be called at startup, before the rules are loaded.
+func Configure(opts ...Option) {
+	engine.Store(NewEngine(opts...))
+}
+
+// Engine routes events to the targets of the rules matching them.
+// The expressions of its rules are compiled when they are added, and the enabled rules are indexed,
+// so that an event is only evaluated against the rules that may match it.
+// An Engine is safe for concurrent use. Changes to its rules are atomic:
+// every event is matched against either all or none of the rules of a change.
+type Engine struct {
+	cfg        *optconfig
+	windows    *ast.Windows
+	mu         sync.Mutex            // serializes changes to the rules
+	rules      map[string]*compiled  // by ID
+	strategies map[string]Strategy   // by event
+	table      atomic.Pointer[table] // the enabled rules, rebuilt when the rules change
+	revision   atomic.Int64          // the revision of the store the rules were loaded from, see Load
+}
+
+type compiled struct {
+	Rule
+	program   *ast.Program
+	actions   []compiledAction
+	sampleKey *ast.Value // the sample key of a partial rollout
+}
+
+// table indexes the enabled rules. It is never modified once built.
+type table struct {
+	rules      []*compiled // by id in the index
+	byID       map[string]*compiled
+	index      *ast.Index
+	total      int // the number of rules, enabled or not
+	strategies map[string]Strategy
+	strategy   Strategy // the strategy of the events without one
+	trace      bool     // whether routings hold traces, see WithTraces
+}
+
+// Routing is how an event was routed by the rules.
+type Routing struct {
+	Strategy Strategy
+	Matched  []Rule                // the rules matching the event, by decreasing priority
+	Fired    []Rule                // the rules among them that fired according to the strategy
+	Traces   map[string]*ast.Trace // by rule ID, the evaluations of the rules that may match the event, see WithTraces
+}
+
+// NewEngine returns an engine without rules.
+func NewEngine(opts ...Option) *Engine {
+	cfg := newConfig(opts)
+	e := &Engine{
+		cfg:        cfg,
+		windows:    ast.NewWindows(cfg.maxWindowKeys),
+		rules:      make(map[string]*compiled),
+		strategies: make(map[string]Strategy),
+	}
+	for event, s := range cfg.strategies {
+		e.strategies[event] = s
+	}
+	e.table.Store(&table{byID: make(map[string]*compiled), index: ast.NewIndex(), strategies: e.copyStrategies(), strategy: cfg.strategy, trace: cfg.trace})
+	e.revision.Store(-1)
+	return e
+}
+
+func (e *Engine) compile(r Rule) (*compiled, error) {
+	if r.ID == "" {
+		return nil, fmt.Errorf("rule %q has no id", r.Name)
+	}
+	sampleKey, err := compileSampleKey(r)
+	if err != nil {
+		return nil, fmt.Errorf("rule %s: %w", r.ID, err)
+	}
+	opts := append([]ast.Option{ast.WithWindows(e.windows, r.ID)}, e.cfg.astOptions...)
+	p, err := ast.Compile(r.Expression, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("rule %s: %w", r.ID, err)
+	}
+	c := &compiled{Rule: r, program: p, sampleKey: sampleKey}
+	// computed fields are evaluated once per delivery, so they are compiled without windows and may not use aggregates
+	for i, a := range r.Actions {
+		ca, err := compileAction(a, e.cfg.astOptions)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: action %d: %w", r.ID, i, err)
+		}
+		c.actions = append(c.actions, ca)
+	}
+	return c, nil
+}
+
+// Add adds a rule, replacing the rule with the same ID, if any.
+// It returns an error if the expression of the rule does not compile.
+func (e *Engine) Add(r Rule) error {
+	c, err := e.compile(r)
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.rules[r.ID] = c
+	e.rebuild()
+	return nil
+}
+
+// Remove removes the rule with the ID, if any.
+func (e *Engine) Remove(id string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.rules[id]; ok {
+		delete(e.rules, id)
+		e.rebuild()
+	}
+}
+
+// Set replaces all the rules of the engine. If any rule does not compile, the rules are left unchanged
+// and the errors of all the rules that do not compile are returned.
+func (e *Engine) Set(rules []Rule) error {
+	compiledRules := make(map[string]*compiled, len(rules))
+	var errs []error
+	for _, r := range rules {
+		c, err := e.compile(r)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		compiledRules[r.ID] = c
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.rules = compiledRules
+	e.rebuild()
+	return nil
+}
+
+// setValid replaces all the rules of the engine by the rules that compile. The rules that do not compile
+// keep their current version, if any, and their errors are returned.
+func (e *Engine) setValid(rules []Rule) error {
+	compiledRules := make(map[string]*compiled, len(rules))
+	var (
+		errs   []error
+		failed []string
+	)
+	for _, r := range rules {
+		c, err := e.compile(r)
+		if err != nil {
+			errs = append(errs, err)
+			failed = append(failed, r.ID)
+			continue
+		}
+		compiledRules[r.ID] = c
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, id := range failed {
+		if c, ok := e.rules[id]; ok {
+			compiledRules[id] = c
+		}
+	}
+	e.rules = compiledRules
+	e.rebuild()
+	return errors.Join(errs...)
+}
+
+// SetStrategy sets the strategy deciding which of the rules matching the events named event fire,
+// i.e. the events that the event manager of that name receives without rules. The default is AllMatch,
+// unless WithStrategy or WithEventStrategy is given.
+func (e *Engine) SetStrategy(event string, s Strategy) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.strategies[event] = s
+	t := *e.table.Load()
+	t.strategies = e.copyStrategies()
+	e.table.Store(&t)
+}
+
+// rebuild rebuilds the table of enabled rules. It must be called with mu locked.
+func (e *Engine) rebuild() {
+	t := &table{byID: make(map[string]*compiled), index: ast.NewIndex(), total: len(e.rules), strategies: e.copyStrategies(), strategy: e.cfg.strategy, trace: e.cfg.trace}
+	for _, c := range e.rules {
+		if c.Enabled {
+			t.index.Add(c.program)
+			t.rules = append(t.rules, c)
+			t.byID[c.ID] = c
+		}
+	}
+	e.table.Store(t)
+}
+
+func (e *Engine) copyStrategies() map[string]Strategy {
+	strategies := make(map[string]Strategy, len(e.strategies))
+	for event, s := range e.strategies {
+		strategies[event] = s
+	}
+	return strategies
+}
+
+// Rules returns the rules of the engine, by decreasing priority.
+func (e *Engine) Rules() []Rule {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	rules := make([]Rule, 0, len(e.rules))
+	for _, c := range e.rules {
+		rules = append(rules, c.Rule)
+	}
+	sortRules(rules)
+	return rules
+}
+
+// Len returns the number of rules of the engine, enabled or not.
+func (e *Engine) Len() int {
+	return e.table.Load().total
+}
+
+// Match returns the enabled rules matching the event, by decreasing priority.
+// A rule rolled out to a percentage of events only matches the events it is rolled out to.
+// The rules whose evaluation fails do not match, and their errors are joined in the returned error.
+func (e *Engine) Match(ctx context.Context, event map[string]interface{}) ([]Rule, error) {
+	var errs []error
+	matches := e.table.Load().match(ctx, event, func(r Rule, err error) {
+		errs = append(errs, fmt.Errorf("rule %s: %w", r.ID, err))
+	}, nil)
+	return matches, errors.Join(errs...)
+}
+
+// match returns the rules of the table matching the event, by decreasing priority,
+// passing the rules whose evaluation fails to fail.
+// When traces is not nil, the rules are explained rather than evaluated, and their traces are added to it.
+func (t *table) match(ctx context.Context, event map[string]interface{}, fail func(Rule, error), traces map[string]*ast.Trace) []Rule {
+	var matches []Rule
+	for _, id := range t.index.Candidates(event) {
+		c := t.rules[id]
+		if !c.inRollout(ctx, event) {
+			continue
+		}
+		ok, err := c.evaluate(ctx, event, traces)
+		if err != nil {
+			fail(c.Rule, err)
+			continue
+		}
+		if ok {
+			matches = append(matches, c.Rule)
+		}
+	}
+	sortRules(matches)
+	return matches
+}
+
+// evaluate evaluates the rule against the event, or explains it when traces is not nil.
+// Explaining instead of evaluating records the event once in the windows of the rule, as evaluating does.
+func (c *compiled) evaluate(ctx context.Context, event map[string]interface{}, traces map[string]*ast.Trace) (bool, error) {
+	if traces == nil {
+		return c.program.EvaluateContext(ctx, event)
+	}
+	trace, err := c.program.ExplainContext(ctx, event)
+	if trace != nil {
+		traces[c.ID] = trace
+	}
+	if err != nil {
+		return false, err
+	}
+	ok, _ := trace.Result.(bool)
+	return ok, nil
+}
+
+// route matches an event against the rules of the table, and decides which fire according to the strategy of the event.
+func (t *table) route(ctx context.Context, name string, event map[string]interface{}, fail func(Rule, error)) *Routing {
+	s, ok := t.strategies[name]
+	if !ok {
+		s = t.strategy
+	}
+	var traces map[string]*ast.Trace
+	if t.trace {
+		traces = make(map[string]*ast.Trace)
+	}
+	matches := t.match(ctx, event, fail, traces)
+	return &Routing{Strategy: s, Matched: matches, Fired: s.fire(matches), Traces: traces}
+}
+
+// Dispatch delivers the properties of the payload to the targets of the rules matching it that fire,
+// according to the strategy of its event, once per target, and returns how it was routed.
+// The properties delivered for a rule are transformed by its actions.
+// It returns the errors of the rules whose evaluation or actions fail and of the targets that are not found,
+// after delivering the payload to the other targets.
+// Without enabled rules, it returns ErrNoRules and leaves the payload to be routed otherwise.
+func (e *Engine) Dispatch(ctx context.Context, payload encoding.Payload) (*Routing, error) {
+	t := e.table.Load()
+	if len(t.rules) == 0 {
+		return nil, ErrNoRules
+	}
+	var errs []error
+	routing := t.route(ctx, payload.GetEvent(), ast.FromPayload(payload), func(r Rule, err error) {
+		errs = append(errs, fmt.Errorf("rule %s: %w", r.ID, err))
+	})
+	for _, r := range deliveries(routing.Fired) {
+		properties, err := transform(ctx, t.byID[r.ID].actions, payload)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("rule %s: %w", r.ID, err))
+			continue
+		}
+		if err := deliver(r.Target, properties); err != nil {
+			errs = append(errs, fmt.Errorf("rule %s: %w", r.ID, err))
+		}
+	}
+	return routing, errors.Join(errs...)
+}
+
+// deliveries returns the rules among the matches that an event is delivered for: the first one of every target.
+func deliveries(matches []Rule) []Rule {
+	var rules []Rule
+	delivered := make(map[string]bool, len(matches))
+	for _, r := range matches {
+		if !delivered[r.Target] {
+			delivered[r.Target] = true
+			rules = append(rules, r)
+		}
+	}
+	return rules
+}
+
+// sortRules sorts rules by decreasing priority, then by ID.
+func sortRules(rules []Rule) {
+	sort.Slice(rules, func(i, j int) bool {
+		if rules[i].Priority != rules[j].Priority {
+			return rules[i].Priority > rules[j].Priority
+		}
+		return rules[i].ID < rules[j].ID
+	})
+}
+
+// Validate returns the error that adding the rule would return, without adding it:
+// an error if its expression or actions do not compile with the options of the engine.
+func (e *Engine) Validate(r Rule) error {
+	_, err := e.compile(r)
+	return err
+}
+
+// ASTOptions returns the options that the expressions of the rules of the engine are compiled with, see WithASTOptions.
+func (e *Engine) ASTOptions() []ast.Option {
+	return append([]ast.Option(nil), e.cfg.astOptions...)
+}
+
+func Add(r Rule) error {
+	return engine.Load().Add(r)
+}
+
+func Validate(r Rule) error {
+	return engine.Load().Validate(r)
+}
+
+func ASTOptions() []ast.Option {
+	return engine.Load().ASTOptions()
+}
+
+func Remove(id string) {
+	engine.Load().Remove(id)
+}
+
+func Set(rules []Rule) error {
+	return engine.Load().Set(rules)
+}
+
+func Rules() []Rule {
+	return engine.Load().Rules()
+}
+
+func Len() int {
+	return engine.Load().Len()
+}
+
+func Match(ctx context.Context, event map[string]interface{}) ([]Rule, error) {
+	return engine.Load().Match(ctx, event)
+}
+
+func SetStrategy(event string, s Strategy) {
+	engine.Load().SetStrategy(event, s)
+}
+
+func Dispatch(ctx context.Context, payload encoding.Payload) (*Routing, error) {
+	return engine.Load().Dispatch(ctx, payload)
+}
@@ -0,0 +1,220 @@
+package rule
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mntwo/tasklab/ast"
+	"github.com/mntwo/tasklab/encoding"
+	"github.com/mntwo/tasklab/encoding/json"
+	"github.com/mntwo/tasklab/gen_event"
+)
+
+type recorder struct {
+	mu     sync.Mutex
+	events []gen_event.Event
+}
+
+func (r *recorder) Init() {}
+
+func (r *recorder) HandleEvent(ctx context.Context, event gen_event.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+}
+
+func (r *recorder) Close() error { return nil }
+
+func (r *recorder) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.events)
+}
+
+// waitCounts waits for the recorders to have received the numbers of events,
+// since handlers receive them asynchronously, and reports what they received otherwise.
+func waitCounts(t *testing.T, what string, recorders []*recorder, want ...int) {
+	t.Helper()
+	got := make([]int, len(recorders))
+	deadline := time.Now().Add(time.Second)
+	for {
+		for i, r := range recorders {
+			got[i] = r.count()
+		}
+		if reflect.DeepEqual(got, want) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%s delivered %v times, want %v", what, got, want)
+	}
+}
+
+func mustParse(t *testing.T, s string) ast.Expression {
+	t.Helper()
+	expr, err := ast.ParseExpression(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return expr
+}
+
+func payload(t *testing.T, data string) encoding.Payload {
+	t.Helper()
+	p := json.New()
+	if err := p.Unmarshal([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestEngineDispatch(t *testing.T) {
+	orders, fraud := &recorder{}, &recorder{}
+	RegisterHandler("test_orders", orders)
+	RegisterHandler("test_fraud", fraud)
+
+	e := NewEngine()
+	rules := []Rule{
+		{ID: "orders", Expression: mustParse(t, `(== event "order")`), Target: "test_orders", Enabled: true},
+		{ID: "big", Expression: mustParse(t, `(and (== event "order") (> amount 1000))`), Target: "test_fraud", Priority: 10, Enabled: true},
+		{ID: "big-again", Expression: mustParse(t, `(> amount 1000)`), Target: "test_fraud", Enabled: true},
+		{ID: "disabled", Expression: mustParse(t, `(== event "order")`), Target: "test_fraud"},
+	}
+	for _, r := range rules {
+		if err := e.Add(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx := context.Background()
+	if _, err := e.Dispatch(ctx, payload(t, `{"event": "order", "properties": {"amount": "50"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	waitCounts(t, "small order", []*recorder{orders, fraud}, 1, 0)
+	if _, err := e.Dispatch(ctx, payload(t, `{"event": "order", "properties": {"amount": "5000"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	waitCounts(t, "big order", []*recorder{orders, fraud}, 2, 1)
+	if _, err := e.Dispatch(ctx, payload(t, `{"event": "signup"}`)); err != nil {
+		t.Fatal(err)
+	}
+	waitCounts(t, "signup", []*recorder{orders, fraud}, 2, 1)
+
+	matches, err := e.Match(ctx, map[string]interface{}{"event": "order", "amount": 5000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, r := range matches {
+		ids = append(ids, r.ID)
+	}
+	if want := []string{"big", "big-again", "orders"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("matched %v, want %v", ids, want)
+	}
+
+	e.Remove("orders")
+	if e.Len() != 3 {
+		t.Errorf("Len() = %d after removing a rule, want 3", e.Len())
+	}
+	for _, amount := range []string{"50", "5000"} {
+		if _, err := e.Dispatch(ctx, payload(t, `{"event": "order", "properties": {"amount": "`+amount+`"}}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitCounts(t, "orders after removing the rule of test_orders", []*recorder{orders, fraud}, 2, 2)
+}
+
+func TestEngineErrors(t *testing.T) {
+	e := NewEngine()
+	if err := e.Add(Rule{ID: "bad", Expression: mustParse(t, `(> amount)`)}); err == nil {
+		t.Error("added a rule that does not compile")
+	}
+	if err := e.Validate(Rule{ID: "bad", Expression: mustParse(t, `(> amount)`)}); err == nil {
+		t.Error("validated a rule that does not compile")
+	}
+	if err := e.Validate(Rule{ID: "ok", Expression: mustParse(t, `(> amount 1)`)}); err != nil || e.Len() != 0 {
+		t.Errorf("Validate: got %v and %d rules", err, e.Len())
+	}
+	err := e.Set([]Rule{
+		{ID: "ok", Expression: mustParse(t, `(== event "order")`), Target: "test_missing", Enabled: true},
+		{ID: "bad", Expression: mustParse(t, `(> amount)`), Enabled: true},
+	})
+	if err == nil || e.Len() != 0 {
+		t.Errorf("Set with a bad rule: got %v and %d rules", err, e.Len())
+	}
+	err = e.Set([]Rule{
+		{ID: "ok", Expression: mustParse(t, `(== event "order")`), Target: "test_missing", Enabled: true},
+		{ID: "fails", Expression: mustParse(t, `(> (/ amount 0) 1)`), Target: "test_missing", Enabled: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = e.Dispatch(context.Background(), payload(t, `{"event": "order", "properties": {"amount": "1"}}`))
+	if !errors.Is(err, ErrTargetNotFound) {
+		t.Errorf("got %v, want ErrTargetNotFound", err)
+	}
+	if err == nil || !strings.Contains(err.Error(), "rule fails: ") {
+		t.Errorf("got %v, want the error of rule fails", err)
+	}
+}
+
+func TestDispatchWithoutEnabledRules(t *testing.T) {
+	e := NewEngine()
+	if err := e.Add(Rule{ID: "disabled", Expression: mustParse(t, `(== event "order")`), Target: "test_missing"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Dispatch(context.Background(), payload(t, `{"event": "order"}`)); !errors.Is(err, ErrNoRules) {
+		t.Errorf("got %v, want ErrNoRules", err)
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	defer Configure()
+	r := Rule{ID: "paying", Expression: mustParse(t, `(and (ref is_paying) (> amount 100))`)}
+	if err := Validate(r); err == nil {
+		t.Error("validated a ref without a library")
+	}
+	library := ast.NewLibrary()
+	if err := library.Define("is_paying", mustParse(t, `(== plan "paid")`)); err != nil {
+		t.Fatal(err)
+	}
+	Configure(WithASTOptions(ast.WithLibrary(library)))
+	if err := Validate(r); err != nil {
+		t.Errorf("Validate with a library: %v", err)
+	}
+}
+
+type panicking struct {
+	recorder
+	inited bool
+}
+
+func (p *panicking) Init() { p.inited = true }
+
+func (p *panicking) HandleEvent(ctx context.Context, event gen_event.Event) {
+	p.recorder.HandleEvent(ctx, event)
+	panic("handler failed")
+}
+
+func TestRegisteredHandlers(t *testing.T) {
+	h := &panicking{}
+	RegisterHandler("test_panicking", h)
+	if !h.inited {
+		t.Error("registered a handler without initializing it")
+	}
+	e := NewEngine()
+	if err := e.Add(Rule{ID: "all", Expression: mustParse(t, `(== event "order")`), Target: "test_panicking", Enabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	// the panic is recovered by the event manager of the handler, rather than crashing the dispatching goroutine
+	if _, err := e.Dispatch(context.Background(), payload(t, `{"event": "order"}`)); err != nil {
+		t.Fatal(err)
+	}
+	waitCounts(t, "order", []*recorder{&h.recorder}, 1)
+}
@@ -0,0 +1,86 @@
+package rule
+
+import "github.com/mntwo/tasklab/ast"
+
+type Option interface {
+	apply(cfg *optconfig)
+}
+
+type option func(cfg *optconfig)
+
+func (fn option) apply(cfg *optconfig) {
+	fn(cfg)
+}
+
+type optconfig struct {
+	maxWindowKeys int
+	astOptions    []ast.Option
+	samples       int
+	strategy      Strategy
+	strategies    map[string]Strategy
+	trace         bool
+}
+
+func defaultConfig() *optconfig {
+	return &optconfig{
+		maxWindowKeys: 100000,
+		samples:       5,
+	}
+}
+
+func newConfig(opts []Option) *optconfig {
+	cfg := defaultConfig()
+	for _, opt := range opts {
+		opt.apply(cfg)
+	}
+	return cfg
+}
+
+// WithMaxWindowKeys sets the maximum number of windows the windowed aggregates of the rules keep,
+// see ast.NewWindows. The default is 100000.
+func WithMaxWindowKeys(n int) Option {
+	return option(func(cfg *optconfig) {
+		cfg.maxWindowKeys = n
+	})
+}
+
+// WithASTOptions sets options that the expressions of the rules are compiled with,
+// e.g. ast.WithSchema or ast.WithLibrary.
+func WithASTOptions(opts ...ast.Option) Option {
+	return option(func(cfg *optconfig) {
+		cfg.astOptions = append(cfg.astOptions, opts...)
+	})
+}
+
+// WithSamples sets the number of matched events that Backtest reports for every rule. The default is 5.
+func WithSamples(n int) Option {
+	return option(func(cfg *optconfig) {
+		cfg.samples = n
+	})
+}
+
+// WithStrategy sets the strategy of the events without one, see Engine.SetStrategy. The default is AllMatch.
+func WithStrategy(s Strategy) Option {
+	return option(func(cfg *optconfig) {
+		cfg.strategy = s
+	})
+}
+
+// WithEventStrategy sets the strategy of the events named event, see Engine.SetStrategy.
+func WithEventStrategy(event string, s Strategy) Option {
+	return option(func(cfg *optconfig) {
+		if cfg.strategies == nil {
+			cfg.strategies = make(map[string]Strategy)
+		}
+		cfg.strategies[event] = s
+	})
+}
+
+// WithTraces explains the rules that may match the events being dispatched rather than evaluating them,
+// and returns their traces in the Routing, so that misrouted events can be investigated.
+// Explaining is much slower than evaluating: it is meant for debugging.
+func WithTraces() Option {
+	return option(func(cfg *optconfig) {
+		cfg.trace = true
+	})
+}
@@ -0,0 +1,250 @@
+package postgres_store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mntwo/tasklab/ast"
+	"github.com/mntwo/tasklab/rule"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var _ rule.Store = (*Store)(nil)
+
+// Store persists rules in Postgres: every version of every rule in rule_versions,
+// and the active version of every rule in rules.
+type Store struct {
+	db *gorm.DB
+}
+
+// ruleVersion is a row of rule_versions. Rows are only ever inserted.
+type ruleVersion struct {
+	RuleID     string `gorm:"primaryKey;size:128"`
+	Version    int    `gorm:"primaryKey"`
+	Name       string
+	Expression string // an S expression
+	Target     string
+	Priority   int
+	Enabled    bool
+	Actions    string   // a JSON array of actions
+	Rollout    *float64 // null for all events
+	SampleKey  string
+	Author     string
+	CreatedAt  time.Time
+	Diff       string
+}
+
+func (ruleVersion) TableName() string {
+	return "rule_versions"
+}
+
+// activeRule is a row of rules, pointing to the active version of a rule.
+type activeRule struct {
+	RuleID    string `gorm:"primaryKey;size:128"`
+	Version   int
+	UpdatedAt time.Time
+}
+
+func (activeRule) TableName() string {
+	return "rules"
+}
+
+// revision is the single row of rule_revision, counting the changes to all rules, see Revision.
+type revision struct {
+	ID       int `gorm:"primaryKey"`
+	Revision int64
+}
+
+func (revision) TableName() string {
+	return "rule_revision"
+}
+
+// New returns a store of rules in db, e.g. db.GetDB("DB1").
+func New(db *gorm.DB) *Store {
+	return &Store{db: db}
+}
+
+// Migrate creates or updates the tables of the store.
+func (s *Store) Migrate(ctx context.Context) error {
+	db := s.db.WithContext(ctx)
+	if err := db.AutoMigrate(&ruleVersion{}, &activeRule{}, &revision{}); err != nil {
+		return err
+	}
+	return db.Clauses(clause.OnConflict{DoNothing: true}).Create(&revision{ID: 1}).Error
+}
+
+// Save refuses rules that do not compile, see rule.Validate, since an active rule that does not compile
+// would not be loaded.
+func (s *Store) Save(ctx context.Context, r rule.Rule, author string) (rule.Version, error) {
+	if err := rule.Validate(r); err != nil {
+		return rule.Version{}, err
+	}
+	expr, err := ast.FormatSExpr(r.Expression)
+	if err != nil {
+		return rule.Version{}, fmt.Errorf("rule %s: %w", r.ID, err)
+	}
+	actions, err := json.Marshal(r.Actions)
+	if err != nil {
+		return rule.Version{}, fmt.Errorf("rule %s: %w", r.ID, err)
+	}
+	var saved ruleVersion
+	err = s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var err error
+		saved, err = s.save(tx, r, expr, string(actions), author)
+		return err
+	})
+	if err != nil {
+		return rule.Version{}, err
+	}
+	return saved.version()
+}
+
+// save saves a version of a rule in the transaction tx.
+func (s *Store) save(tx *gorm.DB, r rule.Rule, expr, actions, author string) (ruleVersion, error) {
+	// counting the change first locks the revision until the transaction commits, which serializes changes:
+	// concurrent changes of a rule get consecutive versions, and the revision increases in the order of the commits,
+	// so that Watch sees every change
+	res := tx.Model(&revision{}).Where("id = 1").Update("revision", gorm.Expr("revision + 1"))
+	if res.Error != nil {
+		return ruleVersion{}, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ruleVersion{}, errors.New("rule_revision is empty, see Migrate")
+	}
+	var (
+		active activeRule
+		prev   *rule.Rule
+	)
+	err := tx.Where("rule_id = ?", r.ID).Take(&active).Error
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+	case err != nil:
+		return ruleVersion{}, err
+	default:
+		var v ruleVersion
+		if err := tx.Where("rule_id = ? AND version = ?", r.ID, active.Version).Take(&v).Error; err != nil {
+			return ruleVersion{}, err
+		}
+		old, err := v.rule()
+		if err != nil {
+			return ruleVersion{}, err
+		}
+		prev = &old
+	}
+	saved := ruleVersion{
+		RuleID:     r.ID,
+		Version:    active.Version + 1,
+		Name:       r.Name,
+		Expression: expr,
+		Target:     r.Target,
+		Priority:   r.Priority,
+		Enabled:    r.Enabled,
+		Actions:    actions,
+		Rollout:    r.Rollout,
+		SampleKey:  r.SampleKey,
+		Author:     author,
+		Diff:       rule.Diff(prev, r),
+	}
+	if err := tx.Create(&saved).Error; err != nil {
+		return ruleVersion{}, err
+	}
+	return saved, tx.Save(&activeRule{RuleID: r.ID, Version: saved.Version}).Error
+}
+
+func (s *Store) Active(ctx context.Context) ([]rule.Rule, error) {
+	var versions []ruleVersion
+	err := s.db.WithContext(ctx).
+		Joins("JOIN rules ON rules.rule_id = rule_versions.rule_id AND rules.version = rule_versions.version").
+		Order("rule_versions.rule_id").
+		Find(&versions).Error
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]rule.Rule, len(versions))
+	for i, v := range versions {
+		if rules[i], err = v.rule(); err != nil {
+			return nil, err
+		}
+	}
+	return rules, nil
+}
+
+func (s *Store) History(ctx context.Context, id string) ([]rule.Version, error) {
+	var rows []ruleVersion
+	if err := s.db.WithContext(ctx).Where("rule_id = ?", id).Order("version").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	versions := make([]rule.Version, len(rows))
+	for i, row := range rows {
+		v, err := row.version()
+		if err != nil {
+			return nil, err
+		}
+		versions[i] = v
+	}
+	return versions, nil
+}
+
+func (s *Store) Rollback(ctx context.Context, id string, version int, author string) (rule.Version, error) {
+	var v ruleVersion
+	err := s.db.WithContext(ctx).Where("rule_id = ? AND version = ?", id, version).Take(&v).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return rule.Version{}, fmt.Errorf("rule %s has no version %d", id, version)
+	}
+	if err != nil {
+		return rule.Version{}, err
+	}
+	r, err := v.rule()
+	if err != nil {
+		return rule.Version{}, err
+	}
+	// e.g. a version using a predicate or a function that no longer exists
+	if err := rule.Validate(r); err != nil {
+		return rule.Version{}, fmt.Errorf("version %d no longer compiles: %w", version, err)
+	}
+	return s.Save(ctx, r, author)
+}
+
+// Revision returns the number of changes to all rules, counted by Save as it commits them.
+func (s *Store) Revision(ctx context.Context) (int64, error) {
+	var r revision
+	err := s.db.WithContext(ctx).Take(&r, 1).Error
+	return r.Revision, err
+}
+
+func (v ruleVersion) rule() (rule.Rule, error) {
+	expr, err := ast.ParseExpression(v.Expression)
+	if err != nil {
+		return rule.Rule{}, fmt.Errorf("rule %s version %d: %w", v.RuleID, v.Version, err)
+	}
+	var actions []rule.Action
+	// versions saved before actions existed have none
+	if v.Actions != "" {
+		if err := json.Unmarshal([]byte(v.Actions), &actions); err != nil {
+			return rule.Rule{}, fmt.Errorf("rule %s version %d: %w", v.RuleID, v.Version, err)
+		}
+	}
+	return rule.Rule{
+		ID:         v.RuleID,
+		Name:       v.Name,
+		Expression: expr,
+		Target:     v.Target,
+		Priority:   v.Priority,
+		Enabled:    v.Enabled,
+		Actions:    actions,
+		Rollout:    v.Rollout,
+		SampleKey:  v.SampleKey,
+	}, nil
+}
+
+func (v ruleVersion) version() (rule.Version, error) {
+	r, err := v.rule()
+	if err != nil {
+		return rule.Version{}, err
+	}
+	return rule.Version{Rule: r, Version: v.Version, Author: v.Author, CreatedAt: v.CreatedAt, Diff: v.Diff}, nil
+}
@@ -0,0 +1,196 @@
+//go:build postgres
+
+package postgres_store
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mntwo/tasklab/ast"
+	"github.com/mntwo/tasklab/rule"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// newStore returns a store in the empty tables of the database of TASKLAB_TEST_POSTGRES_DSN,
+// e.g. "host=localhost user=postgres dbname=tasklab_test sslmode=disable". The tests are skipped without it.
+func newStore(t *testing.T) *Store {
+	t.Helper()
+	dsn := os.Getenv("TASKLAB_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("TASKLAB_TEST_POSTGRES_DSN is not set")
+	}
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Migrator().DropTable(&ruleVersion{}, &activeRule{}, &revision{}); err != nil {
+		t.Fatal(err)
+	}
+	s := New(db)
+	if err := s.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func mustParse(t *testing.T, s string) ast.Expression {
+	t.Helper()
+	expr, err := ast.ParseExpression(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return expr
+}
+
+func format(t *testing.T, expr ast.Expression) string {
+	t.Helper()
+	s, err := ast.FormatSExpr(expr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSaveHistoryRollback(t *testing.T) {
+	s := newStore(t)
+	ctx := context.Background()
+	r := rule.Rule{ID: "big", Name: "big orders", Expression: mustParse(t, `(> amount 100)`), Target: "fraud", Enabled: true}
+	v1, err := s.Save(ctx, r, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Expression = mustParse(t, `(> amount 1000)`)
+	r.Priority = 2
+	v2, err := s.Save(ctx, r, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v1.Version != 1 || v2.Version != 2 {
+		t.Errorf("saved versions %d and %d, want 1 and 2", v1.Version, v2.Version)
+	}
+	if want := "expression: (> amount 100) -> (> amount 1000)\npriority: 0 -> 2"; v2.Diff != want {
+		t.Errorf("Diff = %q, want %q", v2.Diff, want)
+	}
+	if _, err := s.Save(ctx, rule.Rule{ID: "bad", Expression: mustParse(t, `(> amount)`)}, "bob"); err == nil {
+		t.Error("saved a rule that does not compile")
+	}
+
+	v3, err := s.Rollback(ctx, "big", 1, "carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v3.Version != 3 || v3.Author != "carol" || v3.Priority != 0 {
+		t.Errorf("rolled back to %+v", v3)
+	}
+	if _, err := s.Rollback(ctx, "big", 9, "carol"); err == nil {
+		t.Error("rolled back to a missing version")
+	}
+
+	history, err := s.History(ctx, "big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 3 || history[0].Author != "alice" || history[1].Diff != v2.Diff {
+		t.Errorf("History = %+v", history)
+	}
+	active, err := s.Active(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(active) != 1 || format(t, active[0].Expression) != "(> amount 100)" {
+		t.Errorf("Active = %+v, want version 1 of big", active)
+	}
+	if n, err := s.Revision(ctx); err != nil || n != 3 {
+		t.Errorf("Revision = %d, %v, want 3", n, err)
+	}
+}
+
+func TestActionsAndRollout(t *testing.T) {
+	s := newStore(t)
+	ctx := context.Background()
+	zero, half := 0.0, 50.0
+	rules := []rule.Rule{
+		{ID: "all", Expression: mustParse(t, `true`), Enabled: true},
+		{ID: "none", Expression: mustParse(t, `true`), Enabled: true, Rollout: &zero},
+		{
+			ID: "half", Expression: mustParse(t, `true`), Enabled: true, Rollout: &half, SampleKey: "user.id",
+			Actions: []rule.Action{
+				{Op: rule.OpMask, Field: "card", Keep: 4},
+				{Op: rule.OpCompute, Field: "total", Expression: mustParse(t, `(* price quantity)`)},
+			},
+		},
+	}
+	for _, r := range rules {
+		if _, err := s.Save(ctx, r, "alice"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	active, err := s.Active(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(active) != 3 {
+		t.Fatalf("Active = %+v", active)
+	}
+	// ordered by ID
+	all, sampled, none := active[0], active[1], active[2]
+	if all.Rollout != nil || len(all.Actions) != 0 {
+		t.Errorf("all = %+v, want no rollout and no actions", all)
+	}
+	if none.Rollout == nil || *none.Rollout != 0 {
+		t.Errorf("none has rollout %v, want 0", none.Rollout)
+	}
+	if sampled.Rollout == nil || *sampled.Rollout != 50 || sampled.SampleKey != "user.id" {
+		t.Errorf("half = %+v", sampled)
+	}
+	if len(sampled.Actions) != 2 || sampled.Actions[0].Keep != 4 || format(t, sampled.Actions[1].Expression) != "(* price quantity)" {
+		t.Errorf("half has actions %+v", sampled.Actions)
+	}
+}
+
+// TestRevisionFollowsCommits saves a rule in a transaction left open while another rule is saved:
+// the second save waits for the first to commit, so that the revision never counts a change that is not visible yet.
+func TestRevisionFollowsCommits(t *testing.T) {
+	s := newStore(t)
+	ctx := context.Background()
+	tx := s.db.WithContext(ctx).Begin()
+	defer tx.Rollback()
+	if _, err := s.save(tx, rule.Rule{ID: "first", Expression: mustParse(t, `true`)}, "true", "[]", "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	second := rule.Rule{ID: "second", Expression: mustParse(t, `true`)}
+	saved := make(chan error, 1)
+	go func() {
+		_, err := s.Save(ctx, second, "bob")
+		saved <- err
+	}()
+	select {
+	case err := <-saved:
+		t.Fatalf("the second save committed before the first one: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if n, err := s.Revision(ctx); err != nil || n != 0 {
+		t.Errorf("Revision = %d, %v before any commit, want 0", n, err)
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-saved; err != nil {
+		t.Fatal(err)
+	}
+	if n, err := s.Revision(ctx); err != nil || n != 2 {
+		t.Errorf("Revision = %d, %v after both commits, want 2", n, err)
+	}
+	active, err := s.Active(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(active) != 2 {
+		t.Errorf("Active = %+v, want both rules", active)
+	}
+}
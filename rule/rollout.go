@@ -0,0 +1,68 @@
+package rule
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+
+	"github.com/mntwo/tasklab/ast"
+)
+
+// rolloutBuckets is the number of buckets events are hashed into, so that rollouts have a precision of 0.01%.
+const rolloutBuckets = 10000
+
+// compileSampleKey checks the rollout of the rule, and compiles its sample key as an identifier,
+// so that it is resolved like the fields of expressions, e.g. user.id. It returns nil without a partial rollout.
+func compileSampleKey(r Rule) (*ast.Value, error) {
+	if r.Rollout == nil || *r.Rollout == 0 || *r.Rollout == 100 {
+		return nil, checkPercentage(r.Rollout)
+	}
+	if err := checkPercentage(r.Rollout); err != nil {
+		return nil, err
+	}
+	if r.SampleKey == "" {
+		return nil, fmt.Errorf("rollout %v%% has no sample key", *r.Rollout)
+	}
+	key, err := ast.CompileValue(ast.Symbol(r.SampleKey))
+	if err != nil {
+		return nil, fmt.Errorf("sample key %s: %w", r.SampleKey, err)
+	}
+	return key, nil
+}
+
+func checkPercentage(p *float64) error {
+	if p != nil && (*p < 0 || *p > 100) {
+		return fmt.Errorf("rollout %v is not a percentage", *p)
+	}
+	return nil
+}
+
+// inRollout reports whether the rule applies to the event according to its rollout.
+// The value of the sample key of the event is hashed with the ID of the rule, so that the same events are chosen
+// on every node and after restarts, events chosen at a percentage are chosen at any greater percentage,
+// and rules rolled out at the same percentage choose different events. Events without the key are not chosen.
+func (c *compiled) inRollout(ctx context.Context, event map[string]interface{}) bool {
+	switch {
+	case c.Rollout == nil || *c.Rollout == 100:
+		return true
+	case *c.Rollout == 0:
+		return false
+	}
+	v, err := c.sampleKey.EvaluateContext(ctx, event)
+	if err != nil || v == nil {
+		return false
+	}
+	h := fnv.New64a()
+	h.Write([]byte(c.ID))
+	h.Write([]byte{0})
+	fmt.Fprint(h, v)
+	return h.Sum64()%rolloutBuckets < uint64(*c.Rollout*rolloutBuckets/100)
+}
+
+// formatRollout formats a rollout as it is shown in diffs.
+func formatRollout(p *float64) string {
+	if p == nil {
+		return "null"
+	}
+	return fmt.Sprint(*p)
+}
@@ -0,0 +1,101 @@
+package rule
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestRollout(t *testing.T) {
+	users := make([]map[string]interface{}, 10000)
+	for i := range users {
+		users[i] = map[string]interface{}{"event": "order", "user_id": fmt.Sprint("user", i)}
+	}
+	chosen := func(r Rule) map[int]bool {
+		t.Helper()
+		e := NewEngine()
+		if err := e.Add(r); err != nil {
+			t.Fatal(err)
+		}
+		m := make(map[int]bool)
+		for i, event := range users {
+			matches, err := e.Match(context.Background(), event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(matches) > 0 {
+				m[i] = true
+			}
+		}
+		return m
+	}
+
+	r := Rule{ID: "new", Expression: mustParse(t, `(== event "order")`), Enabled: true, Rollout: percent(5), SampleKey: "user_id"}
+	five := chosen(r)
+	if n := len(five); n < 400 || n > 600 {
+		t.Errorf("a 5%% rollout matched %d of %d events", n, len(users))
+	}
+	if again := chosen(r); len(again) != len(five) {
+		t.Errorf("a 5%% rollout matched %d events, then %d", len(five), len(again))
+	}
+	r.Rollout = percent(20)
+	twenty := chosen(r)
+	for i := range five {
+		if !twenty[i] {
+			t.Errorf("event %d matched at 5%% but not at 20%%", i)
+		}
+	}
+	other := r
+	other.ID, other.Rollout = "other", percent(5)
+	if same := chosen(other); fmt.Sprint(same) == fmt.Sprint(five) {
+		t.Error("two rules rolled out at 5% matched the same events")
+	}
+	r.Rollout = percent(100)
+	if n := len(chosen(r)); n != len(users) {
+		t.Errorf("a 100%% rollout matched %d of %d events", n, len(users))
+	}
+	r.Rollout = percent(0)
+	if n := len(chosen(r)); n != 0 {
+		t.Errorf("a 0%% rollout matched %d of %d events", n, len(users))
+	}
+	r.Rollout = nil
+	if n := len(chosen(r)); n != len(users) {
+		t.Errorf("a rule without rollout matched %d of %d events", n, len(users))
+	}
+
+	e := NewEngine()
+	for _, invalid := range []Rule{
+		{ID: "no_key", Expression: r.Expression, Rollout: percent(5)},
+		{ID: "too_much", Expression: r.Expression, Rollout: percent(150), SampleKey: "user_id"},
+		{ID: "bad_key", Expression: r.Expression, Rollout: percent(5), SampleKey: "items[*].id"},
+	} {
+		if err := e.Add(invalid); err == nil {
+			t.Errorf("added rule %s with rollout %v", invalid.ID, *invalid.Rollout)
+		}
+	}
+}
+
+func TestRolloutPathKey(t *testing.T) {
+	e := NewEngine()
+	r := Rule{ID: "new", Expression: mustParse(t, `(== event "order")`), Enabled: true, Rollout: percent(50), SampleKey: "user.id"}
+	if err := e.Add(r); err != nil {
+		t.Fatal(err)
+	}
+	matched := 0
+	for i := 0; i < 1000; i++ {
+		event := map[string]interface{}{"event": "order", "user": map[string]interface{}{"id": fmt.Sprint("user", i)}}
+		if matches, _ := e.Match(context.Background(), event); len(matches) > 0 {
+			matched++
+		}
+	}
+	if matched < 400 || matched > 600 {
+		t.Errorf("a 50%% rollout by user.id matched %d of 1000 events", matched)
+	}
+	if matches, _ := e.Match(context.Background(), map[string]interface{}{"event": "order"}); len(matches) > 0 {
+		t.Error("matched an event without the sample key")
+	}
+}
+
+func percent(p float64) *float64 {
+	return &p
+}
@@ -0,0 +1,65 @@
+package rule
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/mntwo/tasklab/ast"
+	"github.com/mntwo/tasklab/event_manager"
+	"github.com/mntwo/tasklab/gen_event"
+)
+
+var (
+	ErrTargetNotFound = errors.New("target not found")
+	ErrNoRules        = errors.New("no enabled rules")
+)
+
+// Rule routes the events its expression matches to its target, transformed by its actions.
+type Rule struct {
+	ID         string
+	Name       string
+	Expression ast.Expression
+	Target     string // the name of a handler registered with RegisterHandler, or else the alias of an event manager
+	Priority   int    // rules of higher priority are matched first
+	Enabled    bool
+	Actions    []Action // applied to the properties of the events delivered to the target
+	Rollout    *float64 // the percentage of events the rule applies to, chosen by SampleKey; nil applies it to all events
+	SampleKey  string   // the field of the events hashed to choose those a partial rollout applies to, e.g. user.id
+}
+
+// handlerBufferSize is the number of events buffered for every handler registered with RegisterHandler.
+const handlerBufferSize = 100
+
+var (
+	handlers = make(map[string]*gen_event.EventManager)
+)
+
+// RegisterHandler registers a handler that rules can target by name, in addition to event managers.
+// The handler gets an event manager of its own, which initializes it and delivers events to it
+// as to the handlers of any event manager: asynchronously, removing it if it panics.
+// It is not safe to call concurrently with dispatching, and is meant to be called at init.
+func RegisterHandler(name string, h gen_event.Handler) {
+	em := gen_event.NewEventManager(handlerBufferSize)
+	em.AddHandler(h)
+	handlers[name] = em
+}
+
+// CloseHandlers closes the handlers registered with RegisterHandler, and the event managers delivering to them.
+func CloseHandlers() {
+	for _, em := range handlers {
+		em.Close()
+	}
+}
+
+// deliver delivers an event to a target: to a handler, or to the handlers of an event manager.
+func deliver(target string, event gen_event.Event) error {
+	if em, ok := handlers[target]; ok {
+		em.Notify(event)
+		return nil
+	}
+	if m, ok := event_manager.GetEventManager(target); ok {
+		m.Notify(event)
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrTargetNotFound, target)
+}
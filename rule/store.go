@@ -0,0 +1,124 @@
+package rule
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mntwo/tasklab/ast"
+)
+
+// Version is an immutable version of a rule. Every change to a rule, including a rollback, creates a new version.
+type Version struct {
+	Rule
+	Version   int // the versions of a rule are numbered from 1
+	Author    string
+	CreatedAt time.Time
+	Diff      string // the changes from the previous version, see Diff
+}
+
+// Store persists the versions of rules.
+type Store interface {
+	// Save creates a new version of a rule, which becomes its active version.
+	// It returns an error without saving anything if the rule does not compile, see Validate.
+	Save(ctx context.Context, r Rule, author string) (Version, error)
+	// Active returns the active version of every rule.
+	Active(ctx context.Context) ([]Rule, error)
+	// History returns the versions of a rule, from the oldest.
+	History(ctx context.Context, id string) ([]Version, error)
+	// Rollback creates a new version of a rule with the contents of one of its earlier versions,
+	// unless that version no longer compiles.
+	Rollback(ctx context.Context, id string, version int, author string) (Version, error)
+	// Revision returns a counter that changes whenever a rule changes.
+	Revision(ctx context.Context) (int64, error)
+}
+
+// Load replaces the rules of the engine by the active versions of the rules of the store.
+// A rule that does not compile, e.g. one using a function that is no longer in the library,
+// does not keep the others from being loaded: it keeps the version loaded before, if any, and its error is returned.
+func (e *Engine) Load(ctx context.Context, store Store) error {
+	// the revision is read first, so that a change made while loading is loaded again by Watch
+	revision, err := store.Revision(ctx)
+	if err != nil {
+		return err
+	}
+	rules, err := store.Active(ctx)
+	if err != nil {
+		return err
+	}
+	err = e.setValid(rules)
+	e.revision.Store(revision)
+	return err
+}
+
+// Watch polls the store every interval until ctx is done, and loads its rules again whenever they change.
+// Events being dispatched while the rules are loaded are matched against the rules loaded before.
+// The errors of polling and loading are passed to onError, if not nil: the rules are left unchanged
+// when the store cannot be polled, and the rules that do not compile are reported once per change, see Load.
+func (e *Engine) Watch(ctx context.Context, store Store, interval time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		revision, err := store.Revision(ctx)
+		if err == nil && revision != e.revision.Load() {
+			err = e.Load(ctx, store)
+		}
+		if err != nil && onError != nil && ctx.Err() == nil {
+			onError(err)
+		}
+	}
+}
+
+// Diff describes the changes from old to new, one changed field per line, e.g.
+//
+//	priority: 1 -> 2
+//	expression: (> amount 100) -> (> amount 1000)
+//
+// old is nil for the first version of a rule.
+func Diff(old *Rule, new Rule) string {
+	if old == nil {
+		old = &Rule{}
+	}
+	var sb strings.Builder
+	field := func(name string, from, to interface{}) {
+		if from != to {
+			fmt.Fprintf(&sb, "%s: %v -> %v\n", name, from, to)
+		}
+	}
+	field("name", strconv.Quote(old.Name), strconv.Quote(new.Name))
+	field("expression", formatExpression(old.Expression), formatExpression(new.Expression))
+	field("target", strconv.Quote(old.Target), strconv.Quote(new.Target))
+	field("priority", old.Priority, new.Priority)
+	field("enabled", old.Enabled, new.Enabled)
+	field("actions", formatActions(old.Actions), formatActions(new.Actions))
+	field("rollout", formatRollout(old.Rollout), formatRollout(new.Rollout))
+	field("sample_key", strconv.Quote(old.SampleKey), strconv.Quote(new.SampleKey))
+	return strings.TrimSuffix(sb.String(), "\n")
+}
+
+// formatExpression formats an expression as an S expression, as it is stored.
+func formatExpression(expr ast.Expression) string {
+	if expr == nil {
+		return "null"
+	}
+	s, err := ast.FormatSExpr(expr)
+	if err != nil {
+		return fmt.Sprint(expr)
+	}
+	return s
+}
+
+func Load(ctx context.Context, store Store) error {
+	return engine.Load().Load(ctx, store)
+}
+
+func Watch(ctx context.Context, store Store, interval time.Duration, onError func(error)) {
+	engine.Load().Watch(ctx, store, interval, onError)
+}
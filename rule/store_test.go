@@ -0,0 +1,155 @@
+package rule
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+type memoryStore struct {
+	mu       sync.Mutex
+	active   []Rule
+	revision int64
+}
+
+func (s *memoryStore) Save(ctx context.Context, r Rule, author string) (Version, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active = append(s.active, r)
+	s.revision++
+	return Version{Rule: r, Version: 1, Author: author}, nil
+}
+
+func (s *memoryStore) Active(ctx context.Context) ([]Rule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Rule(nil), s.active...), nil
+}
+
+func (s *memoryStore) History(ctx context.Context, id string) ([]Version, error) {
+	return nil, nil
+}
+
+func (s *memoryStore) Rollback(ctx context.Context, id string, version int, author string) (Version, error) {
+	return Version{}, nil
+}
+
+func (s *memoryStore) Revision(ctx context.Context) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.revision, nil
+}
+
+func TestDiff(t *testing.T) {
+	r := Rule{ID: "big", Name: "big orders", Expression: mustParse(t, `(> amount 100)`), Target: "fraud", Enabled: true}
+	want := `name: "" -> "big orders"
+expression: null -> (> amount 100)
+target: "" -> "fraud"
+enabled: false -> true`
+	if got := Diff(nil, r); got != want {
+		t.Errorf("Diff of a new rule:\n%s\nwant:\n%s", got, want)
+	}
+
+	changed := r
+	changed.Expression = mustParse(t, `(> amount 1000)`)
+	changed.Priority = 2
+	want = `expression: (> amount 100) -> (> amount 1000)
+priority: 0 -> 2`
+	if got := Diff(&r, changed); got != want {
+		t.Errorf("Diff of a changed rule:\n%s\nwant:\n%s", got, want)
+	}
+	if got := Diff(&r, r); got != "" {
+		t.Errorf("Diff of an unchanged rule: %q", got)
+	}
+}
+
+func TestEngineLoad(t *testing.T) {
+	store := &memoryStore{}
+	ctx := context.Background()
+	if _, err := store.Save(ctx, Rule{ID: "orders", Expression: mustParse(t, `(== event "order")`), Enabled: true}, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	e := NewEngine()
+	if err := e.Add(Rule{ID: "old", Expression: mustParse(t, `(== event "signup")`), Enabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Load(ctx, store); err != nil {
+		t.Fatal(err)
+	}
+	rules := e.Rules()
+	if len(rules) != 1 || rules[0].ID != "orders" {
+		t.Errorf("loaded %v, want the rules of the store", rules)
+	}
+
+	// the rules that do not compile are reported, keep the version loaded before, if any, and the others are loaded
+	store = &memoryStore{}
+	for _, r := range []Rule{
+		{ID: "orders", Expression: mustParse(t, `(> amount)`), Enabled: true},
+		{ID: "bad", Expression: mustParse(t, `(< amount)`), Enabled: true},
+		{ID: "signups", Expression: mustParse(t, `(== event "signup")`), Enabled: true},
+	} {
+		if _, err := store.Save(ctx, r, "bob"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.Load(ctx, store); err == nil {
+		t.Error("loaded rules that do not compile without an error")
+	}
+	rules = e.Rules()
+	if len(rules) != 2 || rules[0].ID != "orders" || rules[1].ID != "signups" {
+		t.Errorf("loaded %v, want orders as loaded before and signups", rules)
+	}
+	if matches, _ := e.Match(ctx, map[string]interface{}{"event": "order"}); len(matches) != 1 {
+		t.Errorf("matched %v, want orders as loaded before", matches)
+	}
+}
+
+func TestEngineWatch(t *testing.T) {
+	store := &memoryStore{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := store.Save(ctx, Rule{ID: "orders", Expression: mustParse(t, `(== event "order")`), Enabled: true}, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	e := NewEngine()
+	if err := e.Load(ctx, store); err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, 1)
+	go e.Watch(ctx, store, time.Millisecond, func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	})
+
+	if _, err := store.Save(ctx, Rule{ID: "signups", Expression: mustParse(t, `(== event "signup")`), Enabled: true}, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return e.Len() == 2 })
+
+	// a rule that does not compile is reported, and the others stay loaded
+	if _, err := store.Save(ctx, Rule{ID: "bad", Expression: mustParse(t, `(> amount)`), Enabled: true}, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-errs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the rule that does not compile was not reported")
+	}
+	if e.Len() != 2 {
+		t.Errorf("Len() = %d after a failed reload, want 2", e.Len())
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
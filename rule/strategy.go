@@ -0,0 +1,53 @@
+package rule
+
+import "fmt"
+
+// Strategy decides which of the rules matching an event fire, delivering the event to their targets.
+type Strategy int
+
+const (
+	AllMatch   Strategy = iota // every matching rule fires
+	FirstMatch                 // only the matching rule of the highest priority fires
+	TopTier                    // every matching rule of the highest priority among them fires
+)
+
+var strategyNames = map[Strategy]string{
+	AllMatch:   "all_match",
+	FirstMatch: "first_match",
+	TopTier:    "top_tier",
+}
+
+func (s Strategy) String() string {
+	if name, ok := strategyNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("Strategy(%d)", int(s))
+}
+
+// ParseStrategy parses the name of a strategy: all_match, first_match or top_tier.
+func ParseStrategy(name string) (Strategy, error) {
+	for s, n := range strategyNames {
+		if n == name {
+			return s, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown strategy %q", name)
+}
+
+// fire returns the rules that fire among matches, sorted by decreasing priority.
+func (s Strategy) fire(matches []Rule) []Rule {
+	if len(matches) == 0 {
+		return nil
+	}
+	switch s {
+	case FirstMatch:
+		return matches[:1]
+	case TopTier:
+		n := 1
+		for n < len(matches) && matches[n].Priority == matches[0].Priority {
+			n++
+		}
+		return matches[:n]
+	}
+	return matches
+}
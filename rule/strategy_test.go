@@ -0,0 +1,96 @@
+package rule
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestStrategy(t *testing.T) {
+	matches := []Rule{{ID: "a", Priority: 10}, {ID: "b", Priority: 10}, {ID: "c", Priority: 1}}
+	tests := []struct {
+		strategy Strategy
+		want     []string
+	}{
+		{AllMatch, []string{"a", "b", "c"}},
+		{FirstMatch, []string{"a"}},
+		{TopTier, []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, r := range tt.strategy.fire(matches) {
+			got = append(got, r.ID)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s fired %v, want %v", tt.strategy, got, tt.want)
+		}
+		if s, err := ParseStrategy(tt.strategy.String()); err != nil || s != tt.strategy {
+			t.Errorf("ParseStrategy(%q) = %v, %v", tt.strategy, s, err)
+		}
+	}
+	if got := FirstMatch.fire(nil); got != nil {
+		t.Errorf("fired %v without matches", got)
+	}
+	if _, err := ParseStrategy("random"); err == nil {
+		t.Error("parsed an unknown strategy")
+	}
+}
+
+func TestEngineStrategy(t *testing.T) {
+	high, low := &recorder{}, &recorder{}
+	RegisterHandler("test_high", high)
+	RegisterHandler("test_low", low)
+	e := NewEngine(WithEventStrategy("order", FirstMatch))
+	err := e.Set([]Rule{
+		{ID: "high", Expression: mustParse(t, `(> amount 100)`), Target: "test_high", Priority: 10, Enabled: true},
+		{ID: "low", Expression: mustParse(t, `(> amount 100)`), Target: "test_low", Enabled: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	routing, err := e.Dispatch(ctx, payload(t, `{"event": "order", "properties": {"amount": "500"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if routing.Strategy != FirstMatch || len(routing.Matched) != 2 || len(routing.Fired) != 1 {
+		t.Errorf("first match routed %+v", routing)
+	}
+	waitCounts(t, "first match", []*recorder{high, low}, 1, 0)
+	routing, err = e.Dispatch(ctx, payload(t, `{"event": "refund", "properties": {"amount": "500"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if routing.Strategy != AllMatch || len(routing.Fired) != 2 {
+		t.Errorf("all match routed %+v", routing)
+	}
+	waitCounts(t, "all match", []*recorder{high, low}, 2, 1)
+
+	e.SetStrategy("refund", TopTier)
+	if routing, _ := e.Dispatch(ctx, payload(t, `{"event": "refund", "properties": {"amount": "500"}}`)); routing.Strategy != TopTier || len(routing.Fired) != 1 {
+		t.Errorf("top tier routed %+v", routing)
+	}
+}
+
+func TestRoutingTraces(t *testing.T) {
+	e := NewEngine(WithTraces())
+	err := e.Set([]Rule{
+		{ID: "big", Expression: mustParse(t, `(and (== event "order") (> amount 1000))`), Target: "test_missing", Enabled: true},
+		{ID: "bursts", Expression: mustParse(t, `(> (window_count user "1m") 1)`), Target: "test_missing", Enabled: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := payload(t, `{"event": "order", "properties": {"amount": "500", "user": "a"}}`)
+	routing, _ := e.Dispatch(context.Background(), p)
+	big, bursts := routing.Traces["big"], routing.Traces["bursts"]
+	if big == nil || big.Result != false || len(big.Children) != 2 || bursts == nil || bursts.Result != false {
+		t.Fatalf("got traces %v", routing.Traces)
+	}
+	// the event is recorded once in the window, as when evaluating
+	routing, _ = e.Dispatch(context.Background(), p)
+	if len(routing.Fired) != 1 || routing.Traces["bursts"].Result != true {
+		t.Errorf("second event: routed %+v", routing)
+	}
+}